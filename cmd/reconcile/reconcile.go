@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/etaseq/lenslocked/migrations"
+	"github.com/etaseq/lenslocked/models"
+	"github.com/joho/godotenv"
+)
+
+//--------------------------------------------------------------------------
+// bash
+// # Backfill the images table from the existing gallery directories
+// go run cmd/reconcile/reconcile.go
+//
+// It uses the same IMAGES_* and S3_* variables from .env as the server,
+// so it reconciles whichever image store the server is configured with.
+// Running it more than once is safe, images that already have a row
+// are skipped.
+//---------------------------------------------------------------------------
+
+func main() {
+	err := godotenv.Load()
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := models.Open(models.DefaultPostgresConfig())
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	// Make sure the images table exists before trying to fill it.
+	err = models.MigrateFS(db, migrations.FS, ".")
+	if err != nil {
+		panic(err)
+	}
+
+	imageStore, err := models.NewImageStore(models.ImageStoreConfig{
+		Backend: os.Getenv("IMAGES_STORE"),
+		Dir:     os.Getenv("IMAGES_DIR"),
+		S3: models.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	gs := models.GalleryService{
+		DB:    db,
+		Store: imageStore,
+	}
+	created, err := gs.ReconcileImages()
+	fmt.Printf("Created %d image rows\n", created)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -13,7 +13,8 @@ import (
 type key string
 
 const (
-	userKey key = "user"
+	userKey     key = "user"
+	apiTokenKey key = "api_token"
 )
 
 // Store a User inside context
@@ -39,3 +40,18 @@ func User(ctx context.Context) *models.User {
 
 	return user
 }
+
+// Store the API token a request was authenticated with inside context
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenKey, token)
+}
+
+// Retrieve the API token from the context, nil for requests that were not
+// authenticated with one.
+func APIToken(ctx context.Context) *models.APIToken {
+	token, ok := ctx.Value(apiTokenKey).(*models.APIToken)
+	if !ok {
+		return nil
+	}
+	return token
+}
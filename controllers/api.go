@@ -0,0 +1,404 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/etaseq/lenslocked/context"
+	"github.com/etaseq/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// API serves the JSON API under /api/v1. It is used by apps and scripts,
+// which authenticate with API tokens instead of session cookies (see
+// TokenMiddleware). Since browsers never send the tokens on their own, the
+// API doesn't need CSRF protection.
+type API struct {
+	GalleryService *models.GalleryService
+}
+
+// maxJSONBody limits the size of JSON request bodies.
+const maxJSONBody = 1 << 20
+
+// The JSON representations of galleries and images. Just like the view
+// types of the HTML handlers, these keep the database models from leaking
+// into responses, e.g. the password hash of a gallery.
+type apiGallery struct {
+	ID             int        `json:"id"`
+	Title          string     `json:"title"`
+	Description    string     `json:"description"`
+	Tags           []string   `json:"tags"`
+	Visibility     string     `json:"visibility"`
+	ShareSlug      string     `json:"share_slug"`
+	KeepCameraInfo bool       `json:"keep_camera_info"`
+	AllowDownload  bool       `json:"allow_download"`
+	HasPassword    bool       `json:"has_password"`
+	Images         []apiImage `json:"images,omitempty"`
+}
+
+type apiImage struct {
+	Filename         string    `json:"filename"`
+	OriginalFilename string    `json:"original_filename"`
+	Caption          string    `json:"caption"`
+	AltText          string    `json:"alt_text"`
+	Position         int       `json:"position"`
+	ContentType      string    `json:"content_type"`
+	Bytes            int64     `json:"bytes"`
+	Width            int       `json:"width"`
+	Height           int       `json:"height"`
+	URL              string    `json:"url"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// apiUploadResult is the outcome of a single file of an upload. Error is
+// the same message the edit page shows for the file.
+type apiUploadResult struct {
+	Filename  string    `json:"filename"`
+	Image     *apiImage `json:"image,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Duplicate bool      `json:"duplicate,omitempty"`
+}
+
+func newAPIGallery(gallery *models.Gallery) apiGallery {
+	return apiGallery{
+		ID:          gallery.ID,
+		Title:       gallery.Title,
+		Description: gallery.Description,
+		// An empty list instead of null for galleries without tags.
+		Tags:           append([]string{}, gallery.Tags...),
+		Visibility:     gallery.Visibility,
+		ShareSlug:      gallery.ShareSlug,
+		KeepCameraInfo: gallery.KeepCameraInfo,
+		AllowDownload:  gallery.AllowDownload,
+		HasPassword:    gallery.PasswordHash != "",
+	}
+}
+
+func newAPIImage(image models.Image) apiImage {
+	return apiImage{
+		Filename:         image.Filename,
+		OriginalFilename: image.OriginalFilename,
+		Caption:          image.Caption,
+		AltText:          image.AltText,
+		Position:         image.Position,
+		ContentType:      image.ContentType,
+		Bytes:            image.Bytes,
+		Width:            image.Width,
+		Height:           image.Height,
+		// The HTML route needs a session cookie for private galleries, so
+		// API clients get the one that takes their token.
+		URL: fmt.Sprintf("/api/v1/galleries/%d/images/%s", image.GalleryID,
+			url.PathEscape(image.Filename)),
+		CreatedAt: image.CreatedAt,
+	}
+}
+
+// RequireVerifiedUser is the API version of the middleware with the same
+// name: users need a verified email address to add content.
+func (a API) RequireVerifiedUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil || !user.EmailVerified() {
+			writeJSONError(w, "Verify your email address first",
+				http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Galleries lists the galleries of the user.
+func (a API) Galleries(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	galleries, err := a.GalleryService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// An empty list instead of null for users without galleries.
+	data := make([]apiGallery, 0, len(galleries))
+	for i := range galleries {
+		data = append(data, newAPIGallery(&galleries[i]))
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+func (a API) CreateGallery(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title string `json:"title"`
+	}
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	input.Title = strings.TrimSpace(input.Title)
+	if input.Title == "" {
+		writeJSONError(w, "A title is required", http.StatusUnprocessableEntity)
+		return
+	}
+
+	user := context.User(r.Context())
+	gallery, err := a.GalleryService.Create(input.Title, user.ID)
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/galleries/%d", gallery.ID))
+	writeJSON(w, http.StatusCreated, newAPIGallery(gallery))
+}
+
+// Gallery returns a gallery along with its images.
+func (a API) Gallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := ownGallery(w, r, a.GalleryService)
+	if err != nil {
+		return
+	}
+
+	images, err := a.GalleryService.Images(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	data := newAPIGallery(gallery)
+	for _, image := range images {
+		data.Images = append(data.Images, newAPIImage(image))
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// UpdateGallery renames a gallery or changes its settings. Only the fields
+// present in the request body are changed.
+func (a API) UpdateGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := ownGallery(w, r, a.GalleryService)
+	if err != nil {
+		return
+	}
+
+	var input struct {
+		Title          *string   `json:"title"`
+		Description    *string   `json:"description"`
+		Tags           *[]string `json:"tags"`
+		Visibility     *string   `json:"visibility"`
+		KeepCameraInfo *bool     `json:"keep_camera_info"`
+		AllowDownload  *bool     `json:"allow_download"`
+	}
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	if input.Title != nil {
+		title := strings.TrimSpace(*input.Title)
+		if title == "" {
+			writeJSONError(w, "A title is required",
+				http.StatusUnprocessableEntity)
+			return
+		}
+		gallery.Title = title
+	}
+	if input.Description != nil {
+		gallery.Description = strings.TrimSpace(*input.Description)
+	}
+	if input.Tags != nil {
+		gallery.Tags = models.ParseTags(strings.Join(*input.Tags, ","))
+	}
+	if input.Visibility != nil {
+		if !models.IsVisibility(*input.Visibility) {
+			writeJSONError(w, "Invalid visibility", http.StatusUnprocessableEntity)
+			return
+		}
+		gallery.Visibility = *input.Visibility
+	}
+	if input.KeepCameraInfo != nil {
+		gallery.KeepCameraInfo = *input.KeepCameraInfo
+	}
+	if input.AllowDownload != nil {
+		gallery.AllowDownload = *input.AllowDownload
+	}
+
+	err = a.GalleryService.Update(gallery)
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIGallery(gallery))
+}
+
+func (a API) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := ownGallery(w, r, a.GalleryService)
+	if err != nil {
+		return
+	}
+
+	err = a.GalleryService.Delete(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UploadImages takes the same multipart form as the HTML upload, with the
+// files in the "images" field. Like the HTML upload a file that can't be
+// added doesn't stop the others, so it returns the result of every file.
+// The status is 201 if at least one image was created and 200 otherwise.
+func (a API) UploadImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := ownGallery(w, r, a.GalleryService)
+	if err != nil {
+		return
+	}
+
+	// The same 5mb limit as the HTML upload.
+	err = r.ParseMultipartForm(5 << 20)
+	if err != nil {
+		writeJSONError(w, "Expected a multipart form", http.StatusBadRequest)
+		return
+	}
+
+	fileHeaders := r.MultipartForm.File["images"]
+	if len(fileHeaders) == 0 {
+		writeJSONError(w, "No images uploaded", http.StatusUnprocessableEntity)
+		return
+	}
+
+	results := createImages(a.GalleryService, gallery.ID, fileHeaders)
+	status := http.StatusOK
+	data := make([]apiUploadResult, 0, len(results))
+	for i, uploadResult := range uploadResults(results) {
+		result := apiUploadResult{
+			Filename:  uploadResult.Filename,
+			Error:     uploadResult.Error,
+			Duplicate: uploadResult.Duplicate,
+		}
+		if results[i].Image != nil {
+			image := newAPIImage(*results[i].Image)
+			result.Image = &image
+			status = http.StatusCreated
+		}
+		data = append(data, result)
+	}
+	writeJSON(w, status, data)
+}
+
+// Image serves an image of one of the user's galleries, like the HTML
+// route does for visitors. The "size" query parameter picks one of the
+// resized variants instead of the original.
+func (a API) Image(w http.ResponseWriter, r *http.Request) {
+	gallery, err := ownGallery(w, r, a.GalleryService)
+	if err != nil {
+		return
+	}
+
+	// Sanitize the "filename" to prevent directory traversal attacks.
+	filename := filepath.Base(chi.URLParam(r, "filename"))
+	image, err := a.GalleryService.Image(gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			writeJSONError(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// An unknown size is treated as a request for the original.
+	size := r.URL.Query().Get("size")
+	if !models.IsImageSize(size) {
+		size = ""
+	}
+
+	file, err := a.GalleryService.OpenImage(image, size)
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline",
+		map[string]string{"filename": image.OriginalFilename}))
+	http.ServeContent(w, r, image.Filename, file.ModTime, file)
+}
+
+func (a API) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := ownGallery(w, r, a.GalleryService)
+	if err != nil {
+		return
+	}
+
+	// Sanitize the "filename" to prevent directory traversal attacks.
+	filename := filepath.Base(chi.URLParam(r, "filename"))
+	err = a.GalleryService.DeleteImage(gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			writeJSONError(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// NotFound is the JSON version of the 404 page.
+func (a API) NotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, "Not found", http.StatusNotFound)
+}
+
+// ownGallery looks up the {id} gallery and makes sure it belongs to the
+// user, writing a JSON error if it doesn't. Other users' galleries are
+// reported as not found, the API only ever works with the user's own
+// galleries.
+func ownGallery(w http.ResponseWriter, r *http.Request,
+	galleryService *models.GalleryService) (*models.Gallery, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, "Gallery not found", http.StatusNotFound)
+		return nil, err
+	}
+
+	gallery, err := galleryService.ByID(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			writeJSONError(w, "Gallery not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		writeJSONError(w, "Gallery not found", http.StatusNotFound)
+		return nil, errors.New("gallery belongs to another user")
+	}
+	return gallery, nil
+}
+
+// decodeJSON reads a JSON request body into v. It writes the error
+// response and returns false if the body can't be decoded.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBody)
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		writeJSONError(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/etaseq/lenslocked/context"
+	"github.com/etaseq/lenslocked/errs"
+	"github.com/etaseq/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// CreateAPIToken creates a token for the JSON API and shows it once. Like
+// session tokens only the hash is stored, so it can't be shown again.
+func (u Users) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		err := errs.Public(errors.New("api token without a name"),
+			"Give your token a name, so you can tell your tokens apart.")
+		u.renderSettings(w, r, user, "", err)
+		return
+	}
+
+	// "expires_in" is a number of days, empty for a token that never
+	// expires.
+	var expiresAt *time.Time
+	if v := r.FormValue("expires_in"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days <= 0 {
+			http.Error(w, "Invalid expiry", http.StatusBadRequest)
+			return
+		}
+		expires := time.Now().AddDate(0, 0, days)
+		expiresAt = &expires
+	}
+
+	// FormValue above already parsed the form. The checkboxes send one
+	// "scopes" value per checked scope.
+	token, err := u.APITokenService.Create(user.ID, name, r.PostForm["scopes"],
+		expiresAt)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidScope) {
+			err = errs.Public(err, "Pick at least one scope for your token.")
+			u.renderSettings(w, r, user, "", err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var data struct {
+		Name      string
+		Token     string
+		Scopes    []string
+		ExpiresAt *time.Time
+	}
+	data.Name = token.Name
+	data.Token = token.Token
+	data.Scopes = token.Scopes
+	data.ExpiresAt = token.ExpiresAt
+	u.Templates.APIToken.Execute(w, r, data)
+}
+
+// DeleteAPIToken revokes one of the user's API tokens.
+func (u Users) DeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+
+	err = u.APITokenService.Delete(user.ID, id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/settings", http.StatusFound)
+}
+
+// TokenMiddleware is the UserMiddleWare of the JSON API. Instead of the
+// session cookie it looks at the "Authorization: Bearer <token>" header,
+// so a signed in browser can't be used to call the API.
+type TokenMiddleware struct {
+	APITokenService *models.APITokenService
+}
+
+// SetUser stores the user and the token of requests carrying an API token
+// in the context. Unlike UserMiddleWare.SetUser, an invalid or expired
+// token is rejected right away, since scripts have no other way to find
+// out why their requests stopped working.
+func (tmw TokenMiddleware) SetUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, apiToken, err := tmw.APITokenService.UserToken(token)
+		if err != nil {
+			switch {
+			case errors.Is(err, models.ErrNotFound):
+				writeTokenError(w, "invalid_token", "Invalid API token",
+					http.StatusUnauthorized)
+			case errors.Is(err, models.ErrTokenExpired):
+				writeTokenError(w, "invalid_token", "API token has expired",
+					http.StatusUnauthorized)
+			default:
+				fmt.Println(err)
+				writeJSONError(w, "Something went wrong",
+					http.StatusInternalServerError)
+			}
+			return
+		}
+
+		ctx := context.WithUser(r.Context(), user)
+		ctx = context.WithAPIToken(ctx, apiToken)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireUser rejects requests without a valid API token.
+func (tmw TokenMiddleware) RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if context.APIToken(r.Context()) == nil {
+			writeTokenError(w, "", "Missing API token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope rejects requests whose token wasn't given scope.
+func (tmw TokenMiddleware) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := context.APIToken(r.Context())
+			if token == nil {
+				writeTokenError(w, "", "Missing API token", http.StatusUnauthorized)
+				return
+			}
+			if !token.HasScope(scope) {
+				writeTokenError(w, "insufficient_scope",
+					"This API token is missing the "+scope+" scope",
+					http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// writeTokenError responds with a JSON error along with the
+// WWW-Authenticate header of RFC 6750.
+func writeTokenError(w http.ResponseWriter, code, msg string, status int) {
+	challenge := `Bearer realm="lenslocked"`
+	if code != "" {
+		challenge += fmt.Sprintf(`, error=%q`, code)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeJSONError(w, msg, status)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
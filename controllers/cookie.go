@@ -1,15 +1,23 @@
 package controllers
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 )
 
 const (
 	CookieSession = "session"
 )
 
-func newCookie(name, value string) *http.Cookie {
+// newCookie creates a cookie that expires at the given time. A zero
+// expires creates a session cookie, which the browser forgets when closed.
+func newCookie(name, value string, expires time.Time) *http.Cookie {
 	cookie := http.Cookie{
 		Name:     name,
 		Value:    value,
@@ -17,11 +25,18 @@ func newCookie(name, value string) *http.Cookie {
 		HttpOnly: true,
 	}
 
+	if !expires.IsZero() {
+		// Expires is for older browsers, MaxAge takes precedence in the
+		// ones that understand it.
+		cookie.Expires = expires
+		cookie.MaxAge = int(time.Until(expires).Seconds())
+	}
+
 	return &cookie
 }
 
-func setCookie(w http.ResponseWriter, name, value string) {
-	cookie := newCookie(name, value)
+func setCookie(w http.ResponseWriter, name, value string, expires time.Time) {
+	cookie := newCookie(name, value, expires)
 	http.SetCookie(w, cookie)
 }
 
@@ -37,7 +52,33 @@ func readCookie(r *http.Request, name string) (string, error) {
 func deleteCookie(w http.ResponseWriter, name string) {
 	// The way we delete a cookie is to override the existing one with
 	// a new cookie, and set its MaxAge field to a value less than 0.
-	cookie := newCookie(name, "")
+	cookie := newCookie(name, "", time.Time{})
 	cookie.MaxAge = -1
 	http.SetCookie(w, cookie)
 }
+
+// signCookieValue appends an HMAC of value to it so that a cookie holding
+// the result can't be forged or tampered with by the client. It doesn't
+// hide the value, so don't put secrets in it.
+func signCookieValue(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyCookieValue checks a value created with signCookieValue and returns
+// the original value if the signature matches.
+func verifyCookieValue(key []byte, signed string) (string, error) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", errors.New("verify cookie: missing signature")
+	}
+	value := signed[:i]
+
+	// hmac.Equal compares in constant time so the signature can't be
+	// guessed byte by byte by timing the responses.
+	if !hmac.Equal([]byte(signCookieValue(key, value)), []byte(signed)) {
+		return "", errors.New("verify cookie: invalid signature")
+	}
+	return value, nil
+}
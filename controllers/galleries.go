@@ -1,28 +1,52 @@
 package controllers
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/etaseq/lenslocked/context"
+	"github.com/etaseq/lenslocked/errs"
 	"github.com/etaseq/lenslocked/models"
+	"github.com/etaseq/lenslocked/ratelimit"
 	"github.com/go-chi/chi/v5"
 )
 
 type Galleries struct {
 	Templates struct {
-		Show  Template
-		New   Template
-		Edit  Template
-		Index Template
+		Show      Template
+		ShowImage Template
+		Unlock    Template
+		New       Template
+		Edit      Template
+		Index     Template
+		Search    Template
 	}
 	GalleryService *models.GalleryService
+	// UnlockKey signs the cookies that remember a visitor entered the
+	// password of a protected gallery.
+	UnlockKey []byte
+	// UnlockLimiter limits how many wrong gallery passwords can be tried.
+	UnlockLimiter *ratelimit.Limiter
 }
 
+const (
+	// How long a visitor stays unlocked after entering a gallery password.
+	unlockDuration = 7 * 24 * time.Hour
+	// maxZipUpload is the largest ZIP archive that can be uploaded.
+	maxZipUpload = 1 << 30
+)
+
 // Render all the galleries of a user.
 func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	// While I could pass the full Gallery model directly to the template,
@@ -32,13 +56,19 @@ func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	// It is also much safer; decoupling the database model from the
 	// view-layer model helps avoid leaking internal state by potentially
 	// exposing important fields to the view.
+	// CoverURL is the thumbnail of the cover image, empty for galleries
+	// without images.
 	type Gallery struct {
-		ID    int
-		Title string
+		ID         int
+		Title      string
+		Visibility string
+		CoverURL   string
+		CoverAlt   string
 	}
 
 	var data struct {
 		Galleries []Gallery
+		Usage     UsageMeter
 	}
 
 	user := context.User(r.Context())
@@ -47,12 +77,32 @@ func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	usage, err := g.GalleryService.Usage(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Usage = newUsageMeter(usage)
+	covers, err := g.GalleryService.Covers(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
 
 	for _, gallery := range galleries {
-		data.Galleries = append(data.Galleries, Gallery{
-			ID:    gallery.ID,
-			Title: gallery.Title,
-		})
+		item := Gallery{
+			ID:         gallery.ID,
+			Title:      gallery.Title,
+			Visibility: gallery.Visibility,
+		}
+		if cover, ok := covers[gallery.ID]; ok {
+			item.CoverURL = fmt.Sprintf("/galleries/%d/images/%s?size=thumb",
+				gallery.ID, url.PathEscape(cover.Filename))
+			item.CoverAlt = cover.AltText
+		}
+		data.Galleries = append(data.Galleries, item)
 	}
 	g.Templates.Index.Execute(w, r, data)
 
@@ -102,22 +152,50 @@ func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	g.renderEdit(w, r, gallery, nil)
+}
+
+// renderEdit renders the edit page of a gallery. results are the outcomes
+// of a bulk upload, which are listed on the page.
+func (g Galleries) renderEdit(w http.ResponseWriter, r *http.Request,
+	gallery *models.Gallery, results []models.ImageResult, errs ...error) {
 	// While I could pass the full Image model directly to the template,
 	// I'm creating a separate, simpler type specifically for the view.
 	// All the code below is the same as in the Show handler.
 	type Image struct {
-		GalleryID       int
-		Filename        string
-		FilenameEscaped string
+		GalleryID        int
+		Filename         string
+		FilenameEscaped  string
+		OriginalFilename string
+		Caption          string
+		AltText          string
+		IsCover          bool
 	}
 
 	var data struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID             int
+		Title          string
+		Description    string
+		Tags           string
+		KeepCameraInfo bool
+		AllowDownload  bool
+		Visibility     string
+		ShareSlug      string
+		HasPassword    bool
+		Images         []Image
+		Results        []UploadResult
 	}
 	data.ID = gallery.ID
 	data.Title = gallery.Title
+	data.Description = gallery.Description
+	data.Tags = strings.Join(gallery.Tags, ", ")
+	data.KeepCameraInfo = gallery.KeepCameraInfo
+	data.AllowDownload = gallery.AllowDownload
+	data.Visibility = gallery.Visibility
+	data.ShareSlug = gallery.ShareSlug
+	data.HasPassword = gallery.PasswordHash != ""
+
+	data.Results = uploadResults(results)
 
 	images, err := g.GalleryService.Images(gallery.ID)
 	if err != nil {
@@ -125,14 +203,21 @@ func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	for _, image := range images {
+	for i, image := range images {
+		// Without a cover picked by the owner, the first image is used.
+		isCover := image.ID == gallery.CoverImageID ||
+			(gallery.CoverImageID == 0 && i == 0)
 		data.Images = append(data.Images, Image{
-			GalleryID:       image.GalleryID,
-			Filename:        image.Filename,
-			FilenameEscaped: url.PathEscape(image.Filename),
+			GalleryID:        image.GalleryID,
+			Filename:         image.Filename,
+			FilenameEscaped:  url.PathEscape(image.Filename),
+			OriginalFilename: image.OriginalFilename,
+			Caption:          image.Caption,
+			AltText:          image.AltText,
+			IsCover:          isCover,
 		})
 	}
-	g.Templates.Edit.Execute(w, r, data)
+	g.Templates.Edit.Execute(w, r, data, errs...)
 }
 
 func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
@@ -150,6 +235,17 @@ func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	}
 
 	gallery.Title = r.FormValue("title")
+	gallery.Description = strings.TrimSpace(r.FormValue("description"))
+	gallery.Tags = models.ParseTags(r.FormValue("tags"))
+	visibility := r.FormValue("visibility")
+	if !models.IsVisibility(visibility) {
+		http.Error(w, "Invalid visibility", http.StatusBadRequest)
+		return
+	}
+	gallery.Visibility = visibility
+	// Unchecked checkboxes are not sent with the form at all.
+	gallery.KeepCameraInfo = r.FormValue("keep_camera_info") == "on"
+	gallery.AllowDownload = r.FormValue("allow_download") == "on"
 	err = g.GalleryService.Update(gallery)
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
@@ -182,7 +278,7 @@ func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+	gallery, basePath, err := g.viewableGallery(w, r)
 	if err != nil {
 		return
 	}
@@ -191,19 +287,37 @@ func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 	// I'm creating a separate, simpler type specifically for the view.
 	// This makes it clearer what data the template actually needs and
 	// also it allows to modify data from the database if needed.
+	// Srcset lists every resized variant so the browser can pick the
+	// smallest one that fits instead of always downloading the original.
 	type Image struct {
 		GalleryID       int
 		Filename        string
 		FilenameEscaped string
+		Caption         string
+		AltText         string
+		Width           int
+		Height          int
+		Srcset          string
 	}
 
+	// BasePath is where the gallery is being viewed from, either
+	// "/galleries/<id>" or "/g/<slug>" for unlisted galleries, so image
+	// links keep working for visitors without access to the ID routes.
 	var data struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID          int
+		Title       string
+		Description string
+		Tags        []string
+		BasePath    string
+		CanDownload bool
+		Images      []Image
 	}
 	data.ID = gallery.ID
 	data.Title = gallery.Title
+	data.Description = gallery.Description
+	data.Tags = gallery.Tags
+	data.BasePath = basePath
+	data.CanDownload = g.canDownload(r, gallery)
 
 	images, err := g.GalleryService.Images(gallery.ID)
 	if err != nil {
@@ -216,20 +330,129 @@ func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 			GalleryID:       image.GalleryID,
 			Filename:        image.Filename,
 			FilenameEscaped: url.PathEscape(image.Filename),
+			Caption:         image.Caption,
+			AltText:         image.AltText,
+			Width:           image.Width,
+			Height:          image.Height,
+			Srcset:          srcset(basePath, image),
 		})
 	}
 	g.Templates.Show.Execute(w, r, data)
 }
 
+// Search lets anyone look for galleries by their title, description, tags
+// or image captions. Visitors only find public galleries, signed in users
+// their own galleries as well.
+func (g Galleries) Search(w http.ResponseWriter, r *http.Request) {
+	type Gallery struct {
+		ID          int
+		Title       string
+		Description string
+		Tags        []string
+	}
+
+	var data struct {
+		Query     string
+		Tag       string
+		Searched  bool
+		Galleries []Gallery
+	}
+	data.Query = r.FormValue("q")
+	data.Tag = r.FormValue("tag")
+	data.Searched = strings.TrimSpace(data.Query) != "" ||
+		strings.TrimSpace(data.Tag) != ""
+
+	viewerID := 0
+	if user := context.User(r.Context()); user != nil {
+		viewerID = user.ID
+	}
+	galleries, err := g.GalleryService.Search(viewerID, data.Query, data.Tag)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range galleries {
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:          gallery.ID,
+			Title:       gallery.Title,
+			Description: excerpt(gallery.Description, 200),
+			Tags:        gallery.Tags,
+		})
+	}
+	g.Templates.Search.Execute(w, r, data)
+}
+
+// excerpt shortens text to at most n characters, cutting at a space.
+func excerpt(text string, n int) string {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	if len(runes) <= n {
+		return string(runes)
+	}
+	cut := string(runes[:n])
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+// ShowImage renders a page for a single image along with the camera
+// details, if the gallery keeps them.
+func (g Galleries) ShowImage(w http.ResponseWriter, r *http.Request) {
+	gallery, basePath, err := g.viewableGallery(w, r)
+	if err != nil {
+		return
+	}
+
+	image, err := g.GalleryService.Image(gallery.ID, g.filename(w, r))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var data struct {
+		BasePath         string
+		GalleryTitle     string
+		Filename         string
+		FilenameEscaped  string
+		OriginalFilename string
+		Caption          string
+		AltText          string
+		Width            int
+		Height           int
+		Srcset           string
+		Camera           models.CameraInfo
+	}
+	data.BasePath = basePath
+	data.GalleryTitle = gallery.Title
+	data.Filename = image.Filename
+	data.FilenameEscaped = url.PathEscape(image.Filename)
+	data.OriginalFilename = image.OriginalFilename
+	data.Caption = image.Caption
+	data.AltText = image.AltText
+	data.Width = image.Width
+	data.Height = image.Height
+	data.Srcset = srcset(basePath, image)
+	// The setting might have been turned off after the image was uploaded.
+	if gallery.KeepCameraInfo {
+		data.Camera = image.Camera
+	}
+	g.Templates.ShowImage.Execute(w, r, data)
+}
+
 func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
 	filename := g.filename(w, r)
-	galleryID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	gallery, _, err := g.viewableGallery(w, r)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
 		return
 	}
 
-	image, err := g.GalleryService.Image(galleryID, filename)
+	image, err := g.GalleryService.Image(gallery.ID, filename)
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
 			http.Error(w, "Image not found", http.StatusNotFound)
@@ -240,7 +463,51 @@ func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.ServeFile(w, r, image.Path)
+	// An unknown size is treated as a request for the original.
+	size := r.URL.Query().Get("size")
+	if !models.IsImageSize(size) {
+		size = ""
+	}
+
+	// The image may live on the local disk or in an object store, so
+	// instead of http.ServeFile I let the GalleryService open it and
+	// serve whatever it hands back.
+	file, err := g.GalleryService.OpenImage(image, size)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	// Browsers use this name when the image is saved, instead of the
+	// generated one in the URL.
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline",
+		map[string]string{"filename": image.OriginalFilename}))
+	http.ServeContent(w, r, image.Filename, file.ModTime, file)
+}
+
+// Download streams a ZIP archive of all the images of the gallery.
+func (g Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, _, err := g.viewableGallery(w, r)
+	if err != nil {
+		return
+	}
+	if !g.canDownload(r, gallery) {
+		http.Error(w, "Downloading this gallery is disabled", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": zipFilename(gallery)}))
+	err = g.GalleryService.WriteZip(w, gallery.ID)
+	if err != nil {
+		// Part of the archive was probably sent already, so there is no way
+		// to send an error page anymore. The archive is cut short, which
+		// the browser or unzip report as a failed download.
+		fmt.Println(err)
+	}
 }
 
 func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
@@ -271,33 +538,110 @@ func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
 	// NOTE: MultipartForm is the parsed multipart form, including file uploads.
 	// This field is only available after ParseMultipartForm is called.
 	fileHeaders := r.MultipartForm.File["images"]
-	for _, fileHeader := range fileHeaders {
-		file, err := fileHeader.Open()
-		if err != nil {
-			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+	if len(fileHeaders) == 0 {
+		editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+		http.Redirect(w, r, editPath, http.StatusFound)
+		return
+	}
+
+	// A bad file doesn't stop the rest of the batch. Instead of
+	// redirecting, the edit page is rendered right away to list what
+	// happened to each file.
+	results := createImages(g.GalleryService, gallery.ID, fileHeaders)
+	g.renderEdit(w, r, gallery, results, uploadError(results)...)
+}
+
+// UploadZip adds every image in a ZIP archive to the gallery. Instead of
+// stopping at the first bad file, the edit page lists which files were
+// added and why the others weren't.
+func (g Galleries) UploadZip(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	// Authorize
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You are not authorized to edit this gallery", http.
+			StatusForbidden)
+		return
+	}
+
+	// Archives can be much larger than single images. Anything above the
+	// 5mb kept in memory is stored in temporary files.
+	r.Body = http.MaxBytesReader(w, r.Body, maxZipUpload)
+	err = r.ParseMultipartForm(5 << 20)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			err = errs.Public(err, fmt.Sprintf("ZIP archives can be at most "+
+				"%d MB.", maxZipUpload>>20))
+			g.renderEdit(w, r, gallery, nil, err)
 			return
 		}
-		defer file.Close()
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
 
-		err = g.GalleryService.CreateImage(gallery.ID, fileHeader.Filename, file)
-		if err != nil {
-			var fileErr models.FileError
-			if errors.As(err, &fileErr) {
-				msg := fmt.Sprintf("%v has an invalid content type or extensions. "+
-					"Only png, jpg and gif files can be uploaded.", fileHeader.Filename)
-				http.Error(w, msg, http.StatusBadRequest)
-				return
-			}
-			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+	fileHeaders := r.MultipartForm.File["zip"]
+	if len(fileHeaders) == 0 {
+		err = errs.Public(errors.New("no zip archive uploaded"),
+			"Please pick a ZIP archive to upload.")
+		g.renderEdit(w, r, gallery, nil, err)
+		return
+	}
+	file, err := fileHeaders[0].Open()
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	results, err := g.GalleryService.CreateImagesFromZip(gallery.ID, file,
+		fileHeaders[0].Size)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidZip) {
+			err = errs.Public(err, fmt.Sprintf("%v is not a ZIP archive that "+
+				"can be read, or it holds more than %d files.",
+				fileHeaders[0].Filename, models.MaxZipEntries))
+			g.renderEdit(w, r, gallery, nil, err)
 			return
 		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.renderEdit(w, r, gallery, results, uploadError(results)...)
+}
+
+func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
 	}
 
+	// Authorize
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You are not authorized to edit this gallery", http.
+			StatusForbidden)
+		return
+	}
+
+	err = g.GalleryService.DeleteImage(gallery.ID, filename)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
 	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
-func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
+// UpdateImage saves the caption and alt text of an image.
+func (g Galleries) UpdateImage(w http.ResponseWriter, r *http.Request) {
 	filename := g.filename(w, r)
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
@@ -312,8 +656,84 @@ func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = g.GalleryService.DeleteImage(gallery.ID, filename)
+	image, err := g.GalleryService.Image(gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	image.Caption = strings.TrimSpace(r.FormValue("caption"))
+	image.AltText = strings.TrimSpace(r.FormValue("alt_text"))
+	err = g.GalleryService.UpdateImage(&image)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// ReorderImages saves the order of the images after the owner dragged
+// them around on the edit page. The form lists every filename in the new
+// order.
+func (g Galleries) ReorderImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	// Authorize
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You are not authorized to edit this gallery", http.
+			StatusForbidden)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	err = g.GalleryService.ReorderImages(gallery.ID, r.PostForm["filename"])
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// SetCover makes an image the cover of its gallery, which is shown in the
+// list of galleries.
+func (g Galleries) SetCover(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	// Authorize
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You are not authorized to edit this gallery", http.
+			StatusForbidden)
+		return
+	}
+
+	err = g.GalleryService.SetCover(gallery, filename)
 	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
@@ -321,6 +741,135 @@ func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
+// canDownload reports whether the visitor may download the whole gallery.
+// Owners can download their own galleries even with downloads disabled.
+func (g Galleries) canDownload(r *http.Request, gallery *models.Gallery) bool {
+	user := context.User(r.Context())
+	return gallery.AllowDownload || (user != nil && user.ID == gallery.UserID)
+}
+
+// zipFilename names the archive of a gallery after its title, without the
+// characters that aren't safe in file names.
+func zipFilename(gallery *models.Gallery) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '-', r == '_':
+			return r
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return -1
+	}, gallery.Title)
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = fmt.Sprintf("gallery-%d", gallery.ID)
+	}
+	return name + ".zip"
+}
+
+// UploadResult is how the edit page shows the outcome of uploading a
+// single file.
+type UploadResult struct {
+	Filename string
+	Error    string
+	// Duplicate is set when the file was skipped because the gallery
+	// already has it.
+	Duplicate bool
+}
+
+// createImages adds every uploaded file to the gallery, carrying on past
+// the ones that fail.
+func createImages(galleryService *models.GalleryService, galleryID int,
+	fileHeaders []*multipart.FileHeader) []models.ImageResult {
+	var results []models.ImageResult
+	for _, fileHeader := range fileHeaders {
+		result := models.ImageResult{
+			Filename: fileHeader.Filename,
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+		result.Image, result.Err = galleryService.CreateImage(galleryID,
+			fileHeader.Filename, file)
+		file.Close()
+		results = append(results, result)
+	}
+	return results
+}
+
+// uploadError returns a public error summarizing how many files of a bulk
+// upload failed, to show above the results on the edit page. It returns
+// nothing when every file was added. Skipped duplicates aren't failures,
+// the results already tell the user about them. Running out of quota is
+// shown as well, since it is about the account rather than the files.
+func uploadError(results []models.ImageResult) []error {
+	var failed int
+	var quotaErr models.QuotaError
+	for _, result := range results {
+		if result.Err != nil && !errors.Is(result.Err, models.ErrDuplicateImage) {
+			failed++
+			errors.As(result.Err, &quotaErr)
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	err := fmt.Errorf("upload: %d of %d files failed", failed, len(results))
+	uploadErrs := []error{errs.Public(err, fmt.Sprintf("%d of %d files could "+
+		"not be uploaded, see the upload results below.", failed,
+		len(results)))}
+	if quotaErr.Issue != "" {
+		uploadErrs = append(uploadErrs, quotaErr)
+	}
+	return uploadErrs
+}
+
+// uploadResults turns the outcomes of a bulk upload into messages for the
+// edit page. Only FileErrors describe the file, other errors are logged
+// and reported vaguely.
+func uploadResults(results []models.ImageResult) []UploadResult {
+	var uploadResults []UploadResult
+	for _, result := range results {
+		uploadResult := UploadResult{
+			Filename: result.Filename,
+		}
+		if result.Err != nil {
+			var fileErr models.FileError
+			var quotaErr models.QuotaError
+			if errors.Is(result.Err, models.ErrDuplicateImage) {
+				uploadResult.Duplicate = true
+			} else if errors.As(result.Err, &fileErr) {
+				uploadResult.Error = fileErr.Issue
+			} else if errors.As(result.Err, &quotaErr) {
+				uploadResult.Error = "over your storage quota"
+			} else {
+				fmt.Println(result.Err)
+				uploadResult.Error = "something went wrong"
+			}
+		}
+		uploadResults = append(uploadResults, uploadResult)
+	}
+	return uploadResults
+}
+
+// srcset builds the value of an img srcset attribute listing the resized
+// variants of an image followed by the original. basePath is the path the
+// gallery is being viewed from (see viewableGallery).
+func srcset(basePath string, image models.Image) string {
+	imageURL := basePath + "/images/" + url.PathEscape(image.Filename)
+
+	var candidates []string
+	for _, variant := range image.Variants() {
+		candidates = append(candidates, fmt.Sprintf("%s?size=%s %dw",
+			imageURL, variant.Size, variant.Width))
+	}
+	candidates = append(candidates, fmt.Sprintf("%s %dw", imageURL, image.Width))
+	return strings.Join(candidates, ", ")
+}
+
 // Sanitize the "filename" to prevent directory traversal attacks.
 func (g Galleries) filename(w http.ResponseWriter, r *http.Request) string {
 	filename := chi.URLParam(r, "filename")
@@ -328,6 +877,207 @@ func (g Galleries) filename(w http.ResponseWriter, r *http.Request) string {
 	return filename
 }
 
+// viewableGallery returns the gallery a visitor wants to see if they are
+// allowed to see it (see visibleGallery). Password protected galleries
+// render the unlock form instead, unless the visitor already unlocked it
+// or owns it.
+func (g Galleries) viewableGallery(w http.ResponseWriter, r *http.Request) (
+	*models.Gallery, string, error) {
+	gallery, basePath, err := g.visibleGallery(w, r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	user := context.User(r.Context())
+	isOwner := user != nil && user.ID == gallery.UserID
+	if gallery.PasswordHash != "" && !isOwner && !g.isUnlocked(r, gallery) {
+		g.renderUnlock(w, r, gallery, basePath)
+		return nil, "", errors.New("gallery is locked")
+	}
+
+	return gallery, basePath, nil
+}
+
+// Unlock checks the password a visitor entered for a protected gallery
+// and remembers that they entered it in a signed cookie.
+func (g Galleries) Unlock(w http.ResponseWriter, r *http.Request) {
+	gallery, basePath, err := g.visibleGallery(w, r)
+	if err != nil {
+		return
+	}
+
+	// Limit the wrong guesses per gallery and per visitor, so that
+	// guessing one gallery's password doesn't lock everyone else out.
+	limitKey := fmt.Sprintf("%d:%s", gallery.ID, clientIP(r))
+	if !g.UnlockLimiter.Allow(limitKey) {
+		err = errs.Public(errors.New("too many gallery unlock attempts"),
+			"Too many wrong passwords. Please try again later.")
+		g.renderUnlock(w, r, gallery, basePath, err)
+		return
+	}
+
+	err = g.GalleryService.CheckPassword(gallery, r.FormValue("password"))
+	if err != nil {
+		if errors.Is(err, models.ErrWrongPassword) {
+			g.UnlockLimiter.Fail(limitKey)
+			err = errs.Public(err, "That password is incorrect.")
+		}
+		g.renderUnlock(w, r, gallery, basePath, err)
+		return
+	}
+	g.UnlockLimiter.Reset(limitKey)
+
+	expires := time.Now().Add(unlockDuration)
+	setCookie(w, unlockCookieName(gallery),
+		signCookieValue(g.UnlockKey, unlockCookieValue(gallery, expires)), expires)
+	http.Redirect(w, r, basePath, http.StatusFound)
+}
+
+// UpdatePassword sets or removes the password of a gallery.
+func (g Galleries) UpdatePassword(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	// Authorize
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You are not authorized to edit this gallery", http.
+			StatusForbidden)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	password := r.FormValue("password")
+	remove := r.FormValue("remove_password") == "on"
+	// An empty form shouldn't silently remove an existing password.
+	if password == "" && !remove {
+		http.Redirect(w, r, editPath, http.StatusFound)
+		return
+	}
+	if remove {
+		password = ""
+	}
+
+	err = g.GalleryService.SetPassword(gallery, password)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) renderUnlock(w http.ResponseWriter, r *http.Request,
+	gallery *models.Gallery, basePath string, errs ...error) {
+	var data struct {
+		Title    string
+		BasePath string
+	}
+	data.Title = gallery.Title
+	data.BasePath = basePath
+	g.Templates.Unlock.Execute(w, r, data, errs...)
+}
+
+// isUnlocked reports whether the request carries a valid unlock cookie for
+// the gallery.
+func (g Galleries) isUnlocked(r *http.Request, gallery *models.Gallery) bool {
+	signed, err := readCookie(r, unlockCookieName(gallery))
+	if err != nil {
+		return false
+	}
+	value, err := verifyCookieValue(g.UnlockKey, signed)
+	if err != nil {
+		return false
+	}
+
+	// value is "<gallery id>|<expiry>|<password fingerprint>"
+	parts := strings.Split(value, "|")
+	if len(parts) != 3 {
+		return false
+	}
+	expiresUnix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	expires := time.Unix(expiresUnix, 0)
+	if time.Now().After(expires) {
+		return false
+	}
+	return value == unlockCookieValue(gallery, expires)
+}
+
+func unlockCookieName(gallery *models.Gallery) string {
+	return fmt.Sprintf("gallery_%d", gallery.ID)
+}
+
+// unlockCookieValue ties the unlock cookie to a single gallery and to its
+// current password. Changing the password changes the fingerprint, which
+// locks out everyone who unlocked the gallery with the old one.
+func unlockCookieValue(gallery *models.Gallery, expires time.Time) string {
+	fingerprint := sha256.Sum256([]byte(gallery.PasswordHash))
+	return fmt.Sprintf("%d|%d|%s", gallery.ID, expires.Unix(),
+		base64.RawURLEncoding.EncodeToString(fingerprint[:8]))
+}
+
+// visibleGallery looks up the gallery a visitor wants to see and makes
+// sure they are allowed to see it. On the share routes the gallery is
+// looked up by its {slug}, everywhere else by its {id}.
+//   - The owner can always see their galleries.
+//   - Public galleries can be seen by anyone, by ID or by slug.
+//   - Unlisted galleries can only be reached through their slug, otherwise
+//     guessing an ID would be enough to find them.
+//
+// Galleries the visitor can't see are reported as not found so that their
+// existence isn't leaked. Along with the gallery it returns the base path
+// the gallery is being viewed from, which links to its images should use.
+func (g Galleries) visibleGallery(w http.ResponseWriter, r *http.Request) (
+	*models.Gallery, string, error) {
+	var gallery *models.Gallery
+	var basePath string
+	var err error
+
+	slug := chi.URLParam(r, "slug")
+	if slug != "" {
+		gallery, err = g.GalleryService.BySlug(slug)
+		if err != nil {
+			if errors.Is(err, models.ErrNotFound) {
+				http.Error(w, "Gallery not found", http.StatusNotFound)
+				return nil, "", err
+			}
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return nil, "", err
+		}
+		basePath = "/g/" + url.PathEscape(slug)
+	} else {
+		gallery, err = g.galleryByID(w, r)
+		if err != nil {
+			return nil, "", err
+		}
+		basePath = fmt.Sprintf("/galleries/%d", gallery.ID)
+	}
+
+	user := context.User(r.Context())
+	isOwner := user != nil && user.ID == gallery.UserID
+
+	var allowed bool
+	switch gallery.Visibility {
+	case models.VisibilityPublic:
+		allowed = true
+	case models.VisibilityUnlisted:
+		allowed = slug != "" || isOwner
+	default:
+		allowed = isOwner
+	}
+	if !allowed {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return nil, "", errors.New("gallery not viewable")
+	}
+
+	return gallery, basePath, nil
+}
+
 // Helper function to avoid minor repetition across Edit, Update, Show and
 // Delete handlers. While the duplication isn't excessive to justify the
 // decision, it improves readability and maintains cleaner handler logic.
@@ -353,3 +1103,24 @@ func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (
 
 	return gallery, nil
 }
+
+// UsageMeter is how pages show how much of their quota a user has used,
+// see the "usage_meter" template.
+type UsageMeter struct {
+	models.Usage
+	BytesText    string
+	MaxBytesText string
+	// The meters turn into a warning past these.
+	HighBytes  int64
+	HighImages int
+}
+
+func newUsageMeter(usage *models.Usage) UsageMeter {
+	return UsageMeter{
+		Usage:        *usage,
+		BytesText:    models.FormatBytes(usage.Bytes),
+		MaxBytesText: models.FormatBytes(usage.MaxBytes),
+		HighBytes:    usage.MaxBytes * 9 / 10,
+		HighImages:   usage.MaxImages * 9 / 10,
+	}
+}
@@ -0,0 +1,240 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/etaseq/lenslocked/context"
+	"github.com/etaseq/lenslocked/errs"
+	"github.com/etaseq/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	cookieOIDCState = "oidc_state"
+	// oidcStateDuration is how long users have to sign in at the provider.
+	oidcStateDuration = 10 * time.Minute
+)
+
+// OIDCSignIn sends the user to the provider to sign in.
+func (u Users) OIDCSignIn(w http.ResponseWriter, r *http.Request) {
+	u.startOIDC(w, r, 0)
+}
+
+// LinkIdentity sends the current user to the provider, to link the account
+// they sign in with there to their LensLocked account. It is a POST so
+// that other sites can't make a signed in user link the attacker's
+// account.
+func (u Users) LinkIdentity(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	u.startOIDC(w, r, user.ID)
+}
+
+// OIDCCallback is where the provider sends the user back to after signing
+// in. Depending on how the flow was started this signs the user in, signs
+// them up or links the provider account to the current user.
+func (u Users) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := u.OIDCProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		http.Error(w, "Page not found", http.StatusNotFound)
+		return
+	}
+
+	authReq, linkUserID, err := u.oidcState(w, r, provider)
+	if err != nil {
+		fmt.Println(err)
+		err = errs.Public(err, "Signing in with "+provider.Name()+" failed. "+
+			"Please try again.")
+		u.renderSignIn(w, r, "", err)
+		return
+	}
+
+	// The user cancelled or the provider refused to sign them in.
+	if providerErr := r.FormValue("error"); providerErr != "" {
+		err = errs.Public(fmt.Errorf("oidc callback: %s", providerErr),
+			"Signing in with "+provider.Name()+" was cancelled.")
+		u.renderSignIn(w, r, "", err)
+		return
+	}
+
+	claims, err := provider.Exchange(authReq, r.FormValue("code"))
+	if err != nil {
+		fmt.Println(err)
+		err = errs.Public(err, "Signing in with "+provider.Name()+" failed. "+
+			"Please try again.")
+		u.renderSignIn(w, r, "", err)
+		return
+	}
+
+	if linkUserID != 0 {
+		u.linkIdentity(w, r, provider, linkUserID, claims)
+		return
+	}
+
+	user, err := u.IdentityService.User(provider.ID(), claims.Subject)
+	if errors.Is(err, models.ErrNotFound) {
+		user, err = u.IdentityService.SignUp(provider.ID(), claims)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrEmailTaken) {
+			err = errs.Public(err, "There already is an account for "+
+				claims.Email+". Sign in to it and link your "+provider.Name()+
+				" account from the settings page.")
+			u.renderSignIn(w, r, claims.Email, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	u.signIn(w, r, user)
+}
+
+// UnlinkIdentity removes one of the current user's provider accounts.
+func (u Users) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+
+	err = u.IdentityService.Delete(user.ID, id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/settings", http.StatusFound)
+}
+
+func (u Users) linkIdentity(w http.ResponseWriter, r *http.Request,
+	provider *models.OIDCProvider, userID int, claims *models.OIDCClaims) {
+	// The user must still be signed in as the one who started linking.
+	user := context.User(r.Context())
+	if user == nil || user.ID != userID {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+
+	_, err := u.IdentityService.Link(user.ID, provider.ID(), claims)
+	if err != nil {
+		if errors.Is(err, models.ErrIdentityTaken) {
+			err = errs.Public(err, "That "+provider.Name()+" account is already "+
+				"linked to a LensLocked account, or you already linked another "+
+				"one.")
+			u.renderSettings(w, r, user, "", err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	u.renderSettings(w, r, user, "Your "+provider.Name()+" account has been "+
+		"linked. You can now sign in with it.")
+}
+
+// startOIDC redirects to the provider. The state, nonce and PKCE verifier
+// are kept in a signed cookie until the provider redirects back. The
+// cookie isn't encrypted, but it only ever lives in the user's own
+// browser, which is where the verifier needs to come back from anyway.
+func (u Users) startOIDC(w http.ResponseWriter, r *http.Request, linkUserID int) {
+	provider, ok := u.OIDCProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		http.Error(w, "Page not found", http.StatusNotFound)
+		return
+	}
+
+	authReq, err := provider.NewAuthRequest()
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	authURL, err := provider.AuthCodeURL(authReq)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	expires := time.Now().Add(oidcStateDuration)
+	value := strings.Join([]string{
+		provider.ID(),
+		authReq.State,
+		authReq.Nonce,
+		authReq.Verifier,
+		strconv.Itoa(linkUserID),
+		strconv.FormatInt(expires.Unix(), 10),
+	}, "|")
+	// The provider redirects back from another site, which a SameSite
+	// Strict cookie wouldn't survive. Lax is what the default amounts to.
+	cookie := newCookie(cookieOIDCState, signCookieValue(u.CookieKey, value), expires)
+	cookie.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, cookie)
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcState reads back the cookie set by startOIDC and checks it belongs
+// to this callback. The cookie is deleted so each flow can only complete
+// once.
+func (u Users) oidcState(w http.ResponseWriter, r *http.Request,
+	provider *models.OIDCProvider) (*models.OIDCAuthRequest, int, error) {
+	signed, err := readCookie(r, cookieOIDCState)
+	if err != nil {
+		return nil, 0, fmt.Errorf("oidc state: %w", err)
+	}
+	deleteCookie(w, cookieOIDCState)
+
+	value, err := verifyCookieValue(u.CookieKey, signed)
+	if err != nil {
+		return nil, 0, fmt.Errorf("oidc state: %w", err)
+	}
+
+	// value is "<provider>|<state>|<nonce>|<verifier>|<link user id>|<expiry>"
+	parts := strings.Split(value, "|")
+	if len(parts) != 6 {
+		return nil, 0, errors.New("oidc state: malformed cookie")
+	}
+	expiresUnix, err := strconv.ParseInt(parts[5], 10, 64)
+	if err != nil || time.Now().After(time.Unix(expiresUnix, 0)) {
+		return nil, 0, errors.New("oidc state: expired")
+	}
+	if parts[0] != provider.ID() {
+		return nil, 0, errors.New("oidc state: wrong provider")
+	}
+	if r.FormValue("state") != parts[1] {
+		return nil, 0, errors.New("oidc state: state doesn't match")
+	}
+	linkUserID, err := strconv.Atoi(parts[4])
+	if err != nil {
+		return nil, 0, fmt.Errorf("oidc state: %w", err)
+	}
+
+	return &models.OIDCAuthRequest{
+		State:    parts[1],
+		Nonce:    parts[2],
+		Verifier: parts[3],
+	}, linkUserID, nil
+}
+
+// sortedProviders returns the providers in a stable order for the sign in
+// and settings pages.
+func (u Users) sortedProviders() []*models.OIDCProvider {
+	providers := make([]*models.OIDCProvider, 0, len(u.OIDCProviders))
+	for _, provider := range u.OIDCProviders {
+		providers = append(providers, provider)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name() < providers[j].Name()
+	})
+	return providers
+}
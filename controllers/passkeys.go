@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/etaseq/lenslocked/context"
+	"github.com/etaseq/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	cookiePasskeyChallenge = "passkey_challenge"
+	// passkeyChallengeDuration matches the timeout given to the browser.
+	passkeyChallengeDuration = 5 * time.Minute
+	// maxPasskeyBody is plenty for any credential a browser sends.
+	maxPasskeyBody = 64 << 10
+)
+
+// The passkey ceremonies run in JavaScript, so these handlers talk JSON.
+// Each ceremony is two requests: one for the options, including a fresh
+// challenge that is kept in a signed cookie, and one to verify what the
+// browser's authenticator returned.
+
+// PasskeyCreationOptions starts registering a passkey for the current user.
+func (u Users) PasskeyCreationOptions(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	challenge, err := u.newPasskeyChallenge(w)
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	options, err := u.PasskeyService.CreationOptions(user, challenge)
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"publicKey": options})
+}
+
+// RegisterPasskey stores the passkey created by the browser.
+func (u Users) RegisterPasskey(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var body struct {
+		Name       string                   `json:"name"`
+		Credential models.PasskeyCredential `json:"credential"`
+	}
+	err := json.NewDecoder(io.LimitReader(r.Body, maxPasskeyBody)).Decode(&body)
+	if err != nil {
+		writeJSONError(w, "Invalid request.", http.StatusBadRequest)
+		return
+	}
+
+	challenge := u.passkeyChallenge(w, r)
+	_, err = u.PasskeyService.Register(user, strings.TrimSpace(body.Name),
+		challenge, body.Credential)
+	if err != nil {
+		fmt.Println(err)
+		if errors.Is(err, models.ErrInvalidPasskey) {
+			writeJSONError(w, "That passkey could not be added.", http.StatusBadRequest)
+			return
+		}
+		writeJSONError(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": "/users/me/settings"})
+}
+
+// DeletePasskey removes one of the current user's passkeys.
+func (u Users) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+
+	err = u.PasskeyService.Delete(user.ID, id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/settings", http.StatusFound)
+}
+
+// PasskeyRequestOptions starts signing in with a passkey.
+func (u Users) PasskeyRequestOptions(w http.ResponseWriter, r *http.Request) {
+	challenge, err := u.newPasskeyChallenge(w)
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	options := u.PasskeyService.RequestOptions(challenge)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"publicKey": options})
+}
+
+// ProcessPasskeySignIn signs the user in once the passkey checks out. The
+// authenticator already verified the user, so unlike a password this
+// doesn't need a second factor.
+func (u Users) ProcessPasskeySignIn(w http.ResponseWriter, r *http.Request) {
+	var credential models.PasskeyCredential
+	err := json.NewDecoder(io.LimitReader(r.Body, maxPasskeyBody)).Decode(&credential)
+	if err != nil {
+		writeJSONError(w, "Invalid request.", http.StatusBadRequest)
+		return
+	}
+
+	challenge := u.passkeyChallenge(w, r)
+	user, err := u.PasskeyService.Authenticate(challenge, credential)
+	if err != nil {
+		fmt.Println(err)
+		if errors.Is(err, models.ErrInvalidPasskey) {
+			writeJSONError(w, "That passkey could not be verified.",
+				http.StatusUnauthorized)
+			return
+		}
+		writeJSONError(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	session, err := u.SessionService.Create(user.ID, r.UserAgent(), clientIP(r))
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	setCookie(w, CookieSession, session.Token, session.ExpiresAt)
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": "/users/me"})
+}
+
+// newPasskeyChallenge creates a challenge and remembers it in a signed
+// cookie until the browser comes back with the response.
+func (u Users) newPasskeyChallenge(w http.ResponseWriter) (string, error) {
+	challenge, err := models.NewPasskeyChallenge()
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(passkeyChallengeDuration)
+	value := fmt.Sprintf("%s|%d", challenge, expires.Unix())
+	setCookie(w, cookiePasskeyChallenge, signCookieValue(u.CookieKey, value),
+		expires)
+	return challenge, nil
+}
+
+// passkeyChallenge returns the challenge stored by newPasskeyChallenge, or
+// an empty string if there is no valid one. The cookie is deleted so the
+// browser starts over next time, but that alone doesn't stop a captured
+// cookie from being replayed. The PasskeyService makes sure every
+// challenge is only used once.
+func (u Users) passkeyChallenge(w http.ResponseWriter, r *http.Request) string {
+	signed, err := readCookie(r, cookiePasskeyChallenge)
+	if err != nil {
+		return ""
+	}
+	deleteCookie(w, cookiePasskeyChallenge)
+
+	value, err := verifyCookieValue(u.CookieKey, signed)
+	if err != nil {
+		return ""
+	}
+	// value is "<challenge>|<expiry>"
+	challenge, expiresStr, ok := strings.Cut(value, "|")
+	if !ok {
+		return ""
+	}
+	expiresUnix, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || time.Now().After(time.Unix(expiresUnix, 0)) {
+		return ""
+	}
+	return challenge
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, msg string, status int) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/etaseq/lenslocked/ratelimit"
+)
+
+// clientIP returns the IP address the request came from.
+// TODO: If the app ever runs behind a proxy, read X-Forwarded-For from the
+// trusted proxy instead. RemoteAddr would then always be the proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limiterKeys returns the rate limiter keys for an attempt on email: one
+// for the IP address making the request, so a single client can't try
+// many accounts, and one for the email, so an account can't be attacked
+// from many addresses.
+func limiterKeys(r *http.Request, email string) (ipKey, emailKey string) {
+	return "ip:" + clientIP(r),
+		"email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// allowAll reports whether limiter allows an attempt for every key.
+func allowAll(limiter *ratelimit.Limiter, keys ...string) bool {
+	for _, key := range keys {
+		if !limiter.Allow(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// waitFor sleeps for the longest delay limiter wants for any of keys. It
+// returns an error if the client went away in the meantime.
+func waitFor(r *http.Request, limiter *ratelimit.Limiter, keys ...string) error {
+	var delay time.Duration
+	for _, key := range keys {
+		delay = max(delay, limiter.Delay(key))
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/etaseq/lenslocked/context"
+	"github.com/etaseq/lenslocked/errs"
+	"github.com/etaseq/lenslocked/models"
+)
+
+// TwoFactor asks a user with a half-session for their two-factor code.
+func (u Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	_, _, err := u.pendingSession(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	u.Templates.TwoFactor.Execute(w, r, nil)
+}
+
+// ProcessTwoFactor finishes signing in. The half-session is swapped for a
+// full one, so its token is never good for anything else.
+func (u Users) ProcessTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, session, err := u.pendingSession(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+
+	key := strconv.Itoa(user.ID)
+	if !u.TwoFactorLimiter.Allow(key) {
+		err = errs.Public(errors.New("too many two-factor attempts"),
+			"Too many wrong codes. Please try again later.")
+		u.Templates.TwoFactor.Execute(w, r, nil, err)
+		return
+	}
+
+	err = u.TwoFactorService.Verify(user.ID, r.FormValue("code"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCode) {
+			u.TwoFactorLimiter.Fail(key)
+			err = errs.Public(err, "That code is invalid.")
+			u.Templates.TwoFactor.Execute(w, r, nil, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.TwoFactorLimiter.Reset(key)
+
+	err = u.SessionService.Delete(session.Token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	session, err = u.SessionService.Create(user.ID, r.UserAgent(), clientIP(r))
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+
+	setCookie(w, CookieSession, session.Token, session.ExpiresAt)
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// SetupTwoFactor starts enrolling an authenticator app for the current
+// user.
+func (u Users) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	enrollment, err := u.TwoFactorService.Setup(user)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.Templates.TwoFactorSetup.Execute(w, r, enrollment)
+}
+
+// EnableTwoFactor checks a code from the newly enrolled authenticator app
+// and shows the recovery codes once it is correct.
+func (u Users) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	codes, err := u.TwoFactorService.Enable(user.ID, r.FormValue("code"))
+	if err != nil {
+		if !errors.Is(err, models.ErrInvalidCode) {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		enrollment, enrollmentErr := u.TwoFactorService.Enrollment(user)
+		if enrollmentErr != nil {
+			fmt.Println(enrollmentErr)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		err = errs.Public(err, "That code is invalid. Make sure the time on "+
+			"your device is correct and try again.")
+		u.Templates.TwoFactorSetup.Execute(w, r, enrollment, err)
+		return
+	}
+
+	u.renderRecoveryCodes(w, r, codes)
+}
+
+// DisableTwoFactor turns two-factor authentication off after checking the
+// current password.
+func (u Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	if !u.confirmPassword(w, r, user, r.FormValue("current_password")) {
+		return
+	}
+
+	err := u.TwoFactorService.Disable(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderSettings(w, r, user, "Two-factor authentication has been turned off.")
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the current user
+// after checking their password.
+func (u Users) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	if !u.confirmPassword(w, r, user, r.FormValue("current_password")) {
+		return
+	}
+
+	codes, err := u.TwoFactorService.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderRecoveryCodes(w, r, codes)
+}
+
+func (u Users) renderRecoveryCodes(w http.ResponseWriter, r *http.Request,
+	codes []string) {
+	var data struct {
+		Codes []string
+	}
+	data.Codes = codes
+	u.Templates.RecoveryCodes.Execute(w, r, data)
+}
+
+// pendingSession returns the half-session of a user who still has to
+// enter their two-factor code. SetUser ignores these sessions, so they
+// have to be looked up here.
+func (u Users) pendingSession(r *http.Request) (*models.User, *models.Session,
+	error) {
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, session, err := u.SessionService.UserSession(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !session.TwoFactorPending {
+		return nil, nil, errors.New("pending session: session is not pending")
+	}
+	return user, session, nil
+}
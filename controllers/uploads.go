@@ -0,0 +1,334 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/etaseq/lenslocked/context"
+	"github.com/etaseq/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// Uploads implements resumable uploads for images that are too large to
+// reliably upload in a single request. It speaks the core protocol of tus
+// (https://tus.io/protocols/resumable-upload) along with its creation,
+// termination and expiration extensions, so existing tus clients work:
+//
+//  1. POST .../uploads with an Upload-Length header and the filename in
+//     Upload-Metadata creates an upload and returns its URL in Location.
+//  2. PATCH <url> sends a chunk starting at the Upload-Offset header.
+//  3. HEAD <url> returns the Upload-Offset to resume from after a failure.
+//
+// Once the last byte arrives the file becomes an image of the gallery.
+// The same handlers serve the HTML app and the JSON API, since they only
+// rely on the user in the context.
+type Uploads struct {
+	GalleryService *models.GalleryService
+	UploadService  *models.UploadService
+}
+
+const tusVersion = "1.0.0"
+
+// Options lets tus clients discover what the server supports.
+func (u Uploads) Options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination,expiration")
+	w.Header().Set("Tus-Max-Size",
+		strconv.FormatInt(u.UploadService.SizeLimit(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (u Uploads) Create(w http.ResponseWriter, r *http.Request) {
+	if !u.checkVersion(w, r) {
+		return
+	}
+	gallery, err := ownGallery(w, r, u.GalleryService)
+	if err != nil {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		writeJSONError(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	// Sanitize the filename to prevent directory traversal attacks.
+	filename := filepath.Base(uploadMetadata(r)["filename"])
+	if filename == "." || filename == "/" {
+		writeJSONError(w, "The filename is missing from Upload-Metadata",
+			http.StatusBadRequest)
+		return
+	}
+	// Don't let anyone upload a huge file only to find out at the end.
+	err = u.GalleryService.CheckFilename(filename)
+	if err != nil {
+		writeJSONError(w, fmt.Sprintf("%v has an invalid extension. Only png, "+
+			"jpg and gif files can be uploaded.", filename),
+			http.StatusUnprocessableEntity)
+		return
+	}
+
+	err = u.GalleryService.CheckQuota(gallery, length)
+	if err != nil {
+		var quotaErr models.QuotaError
+		if errors.As(err, &quotaErr) {
+			writeJSONError(w, quotaErr.Issue, http.StatusForbidden)
+			return
+		}
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	user := context.User(r.Context())
+	upload, err := u.UploadService.Create(user.ID, gallery.ID, filename, length)
+	if err != nil {
+		if errors.Is(err, models.ErrUploadTooLarge) {
+			writeJSONError(w, "The file is too large",
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	location := strings.TrimSuffix(r.URL.Path, "/") + "/" + upload.Token
+	w.Header().Set("Location", location)
+	u.setUploadHeaders(w, upload)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"url":        location,
+		"offset":     upload.Offset,
+		"length":     upload.Length,
+		"expires_at": upload.ExpiresAt,
+	})
+}
+
+// Head tells the client how much of the file was received, which is where
+// it has to resume from.
+func (u Uploads) Head(w http.ResponseWriter, r *http.Request) {
+	upload, err := u.upload(w, r, false)
+	if err != nil {
+		return
+	}
+	u.setUploadHeaders(w, upload)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// Patch receives the next chunk of the file. The chunk that completes the
+// file turns it into an image.
+func (u Uploads) Patch(w http.ResponseWriter, r *http.Request) {
+	if !u.checkVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeJSONError(w, "Content-Type must be application/offset+octet-stream",
+			http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeJSONError(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	upload, err := u.upload(w, r, true)
+	if err != nil {
+		return
+	}
+	// Whatever was received is kept, even when something fails later on.
+	defer u.UploadService.Unlock(upload)
+
+	err = u.UploadService.Append(upload, offset, r.Body)
+	if err != nil {
+		if errors.Is(err, models.ErrUploadOffset) {
+			u.setUploadHeaders(w, upload)
+			writeJSONError(w, "Upload-Offset doesn't match the received bytes",
+				http.StatusConflict)
+			return
+		}
+		// Most likely the connection dropped, in which case nobody is
+		// listening anymore. Whatever was received is kept.
+		fmt.Println(err)
+		u.setUploadHeaders(w, upload)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	if upload.Complete() {
+		err = u.finish(upload)
+		if err != nil {
+			// Not a 409, clients take that as a cue to resume the upload.
+			if errors.Is(err, models.ErrDuplicateImage) {
+				writeJSONError(w, fmt.Sprintf("%v was skipped, the gallery "+
+					"already has this image.", upload.Filename),
+					http.StatusUnprocessableEntity)
+				return
+			}
+			var quotaErr models.QuotaError
+			if errors.As(err, &quotaErr) {
+				writeJSONError(w, quotaErr.Issue, http.StatusForbidden)
+				return
+			}
+			var fileErr models.FileError
+			if errors.As(err, &fileErr) {
+				writeJSONError(w, fmt.Sprintf("%v has an invalid content type or "+
+					"extensions. Only png, jpg and gif files can be uploaded.",
+					upload.Filename), http.StatusUnprocessableEntity)
+				return
+			}
+			fmt.Println(err)
+			writeJSONError(w, "Something went wrong",
+				http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The offset must be saved before the client is told about it.
+	err = u.UploadService.Unlock(upload)
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delete cancels an upload.
+func (u Uploads) Delete(w http.ResponseWriter, r *http.Request) {
+	if !u.checkVersion(w, r) {
+		return
+	}
+	upload, err := u.upload(w, r, true)
+	if err != nil {
+		return
+	}
+	defer u.UploadService.Unlock(upload)
+
+	err = u.UploadService.Delete(upload)
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finish turns a complete upload into an image. Files that aren't valid
+// images, that the gallery already has or that don't fit in the quota
+// will never become one, so those uploads are deleted as well.
+func (u Uploads) finish(upload *models.Upload) error {
+	file, err := u.UploadService.Open(upload)
+	if err != nil {
+		return err
+	}
+	_, err = u.GalleryService.CreateImage(upload.GalleryID, upload.Filename,
+		file)
+	file.Close()
+	if err != nil {
+		var fileErr models.FileError
+		var quotaErr models.QuotaError
+		if errors.As(err, &fileErr) || errors.As(err, &quotaErr) ||
+			errors.Is(err, models.ErrDuplicateImage) {
+			deleteErr := u.UploadService.Delete(upload)
+			if deleteErr != nil {
+				fmt.Println(deleteErr)
+			}
+		}
+		return err
+	}
+
+	// The image exists at this point, reporting an error would only make
+	// the client retry and upload it twice. The Sweeper removes the
+	// leftovers once the upload expires.
+	err = u.UploadService.Delete(upload)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return nil
+}
+
+// upload looks up the {token} upload of the {id} gallery for the user. If
+// lock is true the upload is locked as well, and the caller has to
+// unlock it.
+func (u Uploads) upload(w http.ResponseWriter, r *http.Request, lock bool) (
+	*models.Upload, error) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	user := context.User(r.Context())
+	token := chi.URLParam(r, "token")
+	var upload *models.Upload
+	var err error
+	if lock {
+		upload, err = u.UploadService.Lock(user.ID, token)
+	} else {
+		upload, err = u.UploadService.ByToken(user.ID, token)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			writeJSONError(w, "Upload not found", http.StatusNotFound)
+			return nil, err
+		}
+		if errors.Is(err, models.ErrUploadLocked) {
+			writeJSONError(w, "A chunk of this upload is still being received",
+				http.StatusConflict)
+			return nil, err
+		}
+		fmt.Println(err)
+		writeJSONError(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	if strconv.Itoa(upload.GalleryID) != chi.URLParam(r, "id") {
+		u.UploadService.Unlock(upload)
+		writeJSONError(w, "Upload not found", http.StatusNotFound)
+		return nil, errors.New("upload belongs to another gallery")
+	}
+	return upload, nil
+}
+
+// checkVersion rejects clients speaking another version of tus. Clients
+// that don't send the header at all are fine, so a plain fetch works too.
+func (u Uploads) checkVersion(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	version := r.Header.Get("Tus-Resumable")
+	if version != "" && version != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeJSONError(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+func (u Uploads) setUploadHeaders(w http.ResponseWriter, upload *models.Upload) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// uploadMetadata parses the Upload-Metadata header, a comma separated list
+// of keys each followed by a space and a base64 encoded value.
+func uploadMetadata(r *http.Request) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(r.Header.Get("Upload-Metadata"), ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata
+}
@@ -5,10 +5,14 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/etaseq/lenslocked/context"
 	"github.com/etaseq/lenslocked/errs"
 	"github.com/etaseq/lenslocked/models"
+	"github.com/etaseq/lenslocked/ratelimit"
+	"github.com/go-chi/chi/v5"
 )
 
 // the Template type is an interface I define
@@ -20,11 +24,44 @@ type Users struct {
 		ForgotPassword Template
 		CheckYourEmail Template
 		ResetPassword  Template
+		Sessions       Template
+		VerifyEmail    Template
+		Settings       Template
+		TwoFactor      Template
+		TwoFactorSetup Template
+		RecoveryCodes  Template
+		MagicLinkSent  Template
+		MagicLink      Template
+		APIToken       Template
 	}
-	UserService          *models.UserService
-	SessionService       *models.SessionService
-	PasswordResetService *models.PasswordResetService
-	EmailService         *models.EmailService
+	UserService              *models.UserService
+	SessionService           *models.SessionService
+	PasswordResetService     *models.PasswordResetService
+	EmailVerificationService *models.EmailVerificationService
+	EmailChangeService       *models.EmailChangeService
+	TwoFactorService         *models.TwoFactorService
+	PasskeyService           *models.PasskeyService
+	MagicLinkService         *models.MagicLinkService
+	IdentityService          *models.IdentityService
+	APITokenService          *models.APITokenService
+	EmailService             *models.EmailService
+	// GalleryService tells how much storage the user is using.
+	GalleryService *models.GalleryService
+	// OIDCProviders are the OpenID Connect providers users can sign in
+	// with, by their ID.
+	OIDCProviders map[string]*models.OIDCProvider
+	// TwoFactorLimiter limits how many wrong two-factor codes can be
+	// entered, since there are only a million of them.
+	TwoFactorLimiter *ratelimit.Limiter
+	// SignInLimiter limits wrong passwords per IP address and per email,
+	// and slows down attempts after each failure.
+	SignInLimiter *ratelimit.Limiter
+	// ResetLimiter limits how many password reset and sign in link emails
+	// can be requested per IP address and per email.
+	ResetLimiter *ratelimit.Limiter
+	// CookieKey signs the cookie holding the challenge of a passkey
+	// ceremony.
+	CookieKey []byte
 }
 
 func (u Users) New(w http.ResponseWriter, r *http.Request) {
@@ -57,6 +94,13 @@ func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Failing to send the verification email shouldn't fail the sign up,
+	// the user can ask for a new one from the verify email page.
+	err = u.sendVerificationEmail(user)
+	if err != nil {
+		fmt.Println(err)
+	}
+
 	// I want to create a session and put it in a cookie AFTER I
 	// know that the user has been created.
 	// Notice that instead of ((*user).ID) I do (user.ID) although
@@ -66,7 +110,7 @@ func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 	// struct itself, thanks to automatic dereferencing.
 	// It is perfectly fine to use this as well ((*user).ID) although
 	// the idiomatic approach is (user.ID).
-	session, err := u.SessionService.Create(user.ID)
+	session, err := u.SessionService.Create(user.ID, r.UserAgent(), clientIP(r))
 	if err != nil {
 		fmt.Println(err)
 		// TODO: Long term, I should show a warning about not being able to sign in
@@ -82,16 +126,25 @@ func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 	//	HttpOnly: true,
 	//}
 	//http.SetCookie(w, &cookie)
-	setCookie(w, CookieSession, session.Token)
+	setCookie(w, CookieSession, session.Token, session.ExpiresAt)
 	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
 func (u Users) SignIn(w http.ResponseWriter, r *http.Request) {
+	u.renderSignIn(w, r, r.FormValue("email"))
+}
+
+// renderSignIn shows the sign in page along with a button for every
+// OpenID Connect provider.
+func (u Users) renderSignIn(w http.ResponseWriter, r *http.Request, email string,
+	errs ...error) {
 	var data struct {
-		Email string
+		Email     string
+		Providers []*models.OIDCProvider
 	}
-	data.Email = r.FormValue("email")
-	u.Templates.SignIn.Execute(w, r, data)
+	data.Email = email
+	data.Providers = u.sortedProviders()
+	u.Templates.SignIn.Execute(w, r, data, errs...)
 }
 
 func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
@@ -102,21 +155,156 @@ func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
 	data.Email = r.FormValue("email")
 	data.Password = r.FormValue("password")
 
-	user, err := u.UserService.Authenticate(data.Email, data.Password)
+	ipKey, emailKey := limiterKeys(r, data.Email)
+	if !allowAll(u.SignInLimiter, ipKey, emailKey) {
+		err := errs.Public(errors.New("too many sign in attempts"),
+			"Too many failed sign in attempts. Please try again later.")
+		u.renderSignIn(w, r, data.Email, err)
+		return
+	}
+	err := waitFor(r, u.SignInLimiter, ipKey, emailKey)
+	if err != nil {
+		return
+	}
+
+	user, err := u.UserService.Authenticate(data.Email, data.Password,
+		clientIP(r))
+	if err != nil {
+		fmt.Println(err)
+		switch {
+		case errors.Is(err, models.ErrAccountLocked):
+			// Same message as the rate limit, so it doesn't tell whether the
+			// account exists.
+			err = errs.Public(err, "Too many failed sign in attempts. Please "+
+				"try again later.")
+		case errors.Is(err, models.ErrWrongPassword), errors.Is(err, models.ErrNotFound):
+			u.SignInLimiter.Fail(ipKey)
+			u.SignInLimiter.Fail(emailKey)
+			err = errs.Public(err, "Invalid email or password.")
+		default:
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		u.renderSignIn(w, r, data.Email, err)
+		return
+	}
+	// Only the email is reset. Resetting the IP address would let anyone
+	// with an account of their own keep guessing other passwords.
+	u.SignInLimiter.Reset(emailKey)
+
+	u.signIn(w, r, user)
+}
+
+// ProcessMagicLink emails the user a link to sign in without their
+// password.
+func (u Users) ProcessMagicLink(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Email string
+	}
+	data.Email = r.FormValue("email")
+
+	ipKey, emailKey := limiterKeys(r, data.Email)
+	if !allowAll(u.ResetLimiter, ipKey, emailKey) {
+		err := errs.Public(errors.New("too many sign in link requests"),
+			"Too many sign in links requested. Please try again later.")
+		u.renderSignIn(w, r, data.Email, err)
+		return
+	}
+	u.ResetLimiter.Fail(ipKey)
+	u.ResetLimiter.Fail(emailKey)
+
+	link, err := u.MagicLinkService.Create(data.Email)
+	if err != nil {
+		// Show the same page for unknown emails so this can't be used to
+		// find out who has an account.
+		if errors.Is(err, models.ErrNotFound) {
+			u.Templates.MagicLinkSent.Execute(w, r, data)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	vals := url.Values{
+		"token": {link.Token},
+	}
+	signInURL := "https://www.lenslocked.com/signin/link?" + vals.Encode()
+
+	err = u.EmailService.MagicLink(data.Email, signInURL)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	u.Templates.MagicLinkSent.Execute(w, r, data)
+}
+
+// MagicLink is where the link in the email leads. It doesn't sign the user
+// in by itself, some email providers open every link in an email to scan
+// it, which would use up the token. Instead the user confirms with a
+// button.
+func (u Users) MagicLink(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string
+	}
+	data.Token = r.FormValue("token")
+	u.Templates.MagicLink.Execute(w, r, data)
+}
+
+// ProcessMagicLinkSignIn uses up the sign in link and signs the user in.
+// The link only stands in for the password, so users with two-factor
+// authentication still need to enter their code.
+func (u Users) ProcessMagicLinkSignIn(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string
+	}
+	data.Token = r.FormValue("token")
+
+	user, err := u.MagicLinkService.Consume(data.Token)
+	if err != nil {
+		fmt.Println(err)
+		err = errs.Public(err, "That sign in link is invalid or has expired.")
+		u.Templates.MagicLink.Execute(w, r, data, err)
+		return
+	}
+
+	u.signIn(w, r, user)
+}
+
+// signIn starts a session for a user whose password checked out. Users
+// with two-factor authentication only get a half-session until they enter
+// their code.
+func (u Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) {
+	enabled, err := u.TwoFactorService.Enabled(user.ID)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
 
-	session, err := u.SessionService.Create(user.ID)
+	if enabled {
+		session, err := u.SessionService.CreatePending(user.ID, r.UserAgent(),
+			clientIP(r))
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		setCookie(w, CookieSession, session.Token, session.ExpiresAt)
+		http.Redirect(w, r, "/signin/2fa", http.StatusFound)
+		return
+	}
+
+	session, err := u.SessionService.Create(user.ID, r.UserAgent(), clientIP(r))
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
 
-	setCookie(w, CookieSession, session.Token)
+	setCookie(w, CookieSession, session.Token, session.ExpiresAt)
 	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
@@ -129,6 +317,279 @@ func (u Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Current user: %s\n", user.Email)
 }
 
+// Sessions lists every device the current user is signed in on.
+func (u Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	// RequireUser already made sure the cookie is there.
+	token, _ := readCookie(r, CookieSession)
+
+	sessions, err := u.SessionService.List(user.ID, token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	type Session struct {
+		ID         int
+		UserAgent  string
+		IPAddress  string
+		CreatedAt  time.Time
+		LastSeenAt time.Time
+		Current    bool
+	}
+	var data struct {
+		Sessions []Session
+	}
+	for _, session := range sessions {
+		data.Sessions = append(data.Sessions, Session{
+			ID:         session.ID,
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			Current:    session.Current,
+		})
+	}
+	u.Templates.Sessions.Execute(w, r, data)
+}
+
+// DeleteSession revokes one of the current user's sessions, signing that
+// device out.
+func (u Users) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	sessionID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+
+	err = u.SessionService.DeleteByID(user.ID, sessionID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
+
+// DeleteOtherSessions signs the current user out everywhere except on the
+// device making the request.
+func (u Users) DeleteOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	token, _ := readCookie(r, CookieSession)
+
+	err := u.SessionService.DeleteOthers(user.ID, token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
+
+// Settings shows the account settings page of the current user.
+func (u Users) Settings(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	u.renderSettings(w, r, user, "")
+}
+
+// ProcessChangePassword changes the password of the current user. Anyone
+// who got their hands on the old password could already be signed in, so
+// every other session is signed out as well.
+func (u Users) ProcessChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	currentPassword := r.FormValue("current_password")
+	newPassword := r.FormValue("new_password")
+	// Users who signed up with an identity provider use this to set their
+	// first password.
+	hadPassword := user.PasswordHash != ""
+
+	if !u.confirmPassword(w, r, user, currentPassword) {
+		return
+	}
+
+	err := u.UserService.UpdatePassword(user.ID, newPassword)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	token, _ := readCookie(r, CookieSession)
+	err = u.SessionService.DeleteOthers(user.ID, token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	message := "Your password has been changed and you have been signed " +
+		"out everywhere else."
+	if !hadPassword {
+		message = "Your password has been set. You can now sign in with " +
+			"your email and password as well."
+		// The page only needs to know there is a password now, not its
+		// hash.
+		user.PasswordHash = "set"
+	}
+	u.renderSettings(w, r, user, message)
+}
+
+// confirmPassword checks the current password of the signed in user
+// before a sensitive change. When it returns false a response has been
+// written already. Users who signed up with an identity provider have no
+// password to confirm, being signed in is all they can prove.
+func (u Users) confirmPassword(w http.ResponseWriter, r *http.Request,
+	user *models.User, password string) bool {
+	if user.PasswordHash == "" {
+		return true
+	}
+
+	_, err := u.UserService.Authenticate(user.Email, password, clientIP(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrWrongPassword):
+			err = errs.Public(err, "Your current password is incorrect.")
+		case errors.Is(err, models.ErrAccountLocked):
+			err = errs.Public(err, "Too many wrong passwords. Please try "+
+				"again later.")
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return false
+		}
+		u.renderSettings(w, r, user, "", err)
+		return false
+	}
+	return true
+}
+
+// ProcessChangeEmail starts changing the email of the current user. The
+// email doesn't change until the link sent to the new address is used.
+func (u Users) ProcessChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	newEmail := r.FormValue("email")
+
+	change, err := u.EmailChangeService.Create(user.ID, newEmail)
+	if err != nil {
+		if errors.Is(err, models.ErrEmailTaken) {
+			err = errs.Public(err, "That email address is already associated "+
+				"with an account.")
+		} else {
+			fmt.Println(err)
+		}
+		u.renderSettings(w, r, user, "", err)
+		return
+	}
+
+	vals := url.Values{
+		"token": {change.Token},
+	}
+	confirmURL := "https://www.lenslocked.com/confirm-email?" + vals.Encode()
+
+	err = u.EmailService.ConfirmEmailChange(change.NewEmail, confirmURL)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	u.renderSettings(w, r, user, "An email has been sent to "+change.NewEmail+
+		". Follow the link in it to finish changing your email address.")
+}
+
+// ConfirmEmail handles the link sent to the new address when changing
+// email. It doesn't require being signed in, the link may well be opened
+// on another device.
+func (u Users) ConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	user, oldEmail, err := u.EmailChangeService.Consume(r.FormValue("token"))
+	if err != nil {
+		fmt.Println(err)
+		if errors.Is(err, models.ErrEmailTaken) {
+			http.Error(w, "That email address is already associated with an "+
+				"account.", http.StatusConflict)
+			return
+		}
+		http.Error(w, "That link is invalid or has expired.", http.StatusNotFound)
+		return
+	}
+
+	// The change already happened, so a failing notice is only logged.
+	err = u.EmailService.EmailChanged(oldEmail, user.Email)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	http.Redirect(w, r, "/users/me/settings", http.StatusFound)
+}
+
+func (u Users) renderSettings(w http.ResponseWriter, r *http.Request,
+	user *models.User, message string, errs ...error) {
+	var data struct {
+		Email             string
+		EmailVerified     bool
+		HasPassword       bool
+		TwoFactorEnabled  bool
+		RecoveryCodesLeft int
+		Passkeys          []models.Passkey
+		Identities        []models.Identity
+		Providers         []*models.OIDCProvider
+		APITokens         []models.APIToken
+		Scopes            []string
+		Usage             UsageMeter
+		Message           string
+	}
+	data.Email = user.Email
+	data.EmailVerified = user.EmailVerified()
+	data.HasPassword = user.PasswordHash != ""
+	data.Message = message
+
+	var err error
+	data.TwoFactorEnabled, err = u.TwoFactorService.Enabled(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if data.TwoFactorEnabled {
+		data.RecoveryCodesLeft, err = u.TwoFactorService.RecoveryCodesLeft(user.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+	data.Passkeys, err = u.PasskeyService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Identities, err = u.IdentityService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Providers = u.sortedProviders()
+	data.Scopes = models.Scopes
+	data.APITokens, err = u.APITokenService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	usage, err := u.GalleryService.Usage(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Usage = newUsageMeter(usage)
+	u.Templates.Settings.Execute(w, r, data, errs...)
+}
+
 func (u Users) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
 	token, err := readCookie(r, CookieSession)
 	if err != nil {
@@ -162,6 +623,18 @@ func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 	}
 	data.Email = r.FormValue("email")
 
+	// Every request counts, successful or not, since each one sends an
+	// email.
+	ipKey, emailKey := limiterKeys(r, data.Email)
+	if !allowAll(u.ResetLimiter, ipKey, emailKey) {
+		err := errs.Public(errors.New("too many password reset requests"),
+			"Too many password reset requests. Please try again later.")
+		u.Templates.ForgotPassword.Execute(w, r, data, err)
+		return
+	}
+	u.ResetLimiter.Fail(ipKey)
+	u.ResetLimiter.Fail(emailKey)
+
 	pwReset, err := u.PasswordResetService.Create(data.Email)
 	if err != nil {
 		// TODO: Handle other cases in the future. For instance, if a user does
@@ -222,18 +695,79 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Sign the user in now that the password has been reset.
-	// Any errors from this point onwards should redirect the user to the
-	// sign in page.
-	session, err := u.SessionService.Create(user.ID)
+	// Sign the user in now that the password has been reset. The reset
+	// link only replaces the password, so users with two-factor
+	// authentication still need to enter their code.
+	u.signIn(w, r, user)
+}
+
+// VerifyEmail handles the link from the verification email. Without a
+// token it explains why verification is needed and lets a signed in user
+// ask for a new email.
+func (u Users) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Email string
+		Sent  bool
+	}
+	token := r.FormValue("token")
+	if token == "" {
+		u.Templates.VerifyEmail.Execute(w, r, data)
+		return
+	}
+
+	_, err := u.EmailVerificationService.Consume(token)
 	if err != nil {
 		fmt.Println(err)
-		http.Redirect(w, r, "/signin", http.StatusFound)
+		err = errs.Public(err, "That verification link is invalid or has "+
+			"expired.")
+		u.Templates.VerifyEmail.Execute(w, r, data, err)
 		return
 	}
 
-	setCookie(w, CookieSession, session.Token)
-	http.Redirect(w, r, "/users/me", http.StatusFound)
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// ResendVerificationEmail sends a new verification email to the current
+// user, invalidating the link in any previous one.
+func (u Users) ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user.EmailVerified() {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+
+	err := u.sendVerificationEmail(user)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var data struct {
+		Email string
+		Sent  bool
+	}
+	data.Email = user.Email
+	data.Sent = true
+	u.Templates.VerifyEmail.Execute(w, r, data)
+}
+
+func (u Users) sendVerificationEmail(user *models.User) error {
+	verification, err := u.EmailVerificationService.Create(user.ID)
+	if err != nil {
+		return fmt.Errorf("send verification email: %w", err)
+	}
+
+	vals := url.Values{
+		"token": {verification.Token},
+	}
+	verifyURL := "https://www.lenslocked.com/verify-email?" + vals.Encode()
+
+	err = u.EmailService.VerifyEmail(user.Email, verifyURL)
+	if err != nil {
+		return fmt.Errorf("send verification email: %w", err)
+	}
+	return nil
 }
 
 // I am adding the middleware for the users here because the application
@@ -265,12 +799,29 @@ func (umw UserMiddleWare) SetUser(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := umw.SessionService.User(token)
+		user, session, err := umw.SessionService.UserSession(token)
 		if err != nil {
+			// Don't keep sending a cookie for a session that is gone.
+			if errors.Is(err, models.ErrSessionExpired) {
+				deleteCookie(w, CookieSession)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A half-session can only be used to finish signing in, so the
+		// user is not set.
+		if session.TwoFactorPending {
 			next.ServeHTTP(w, r)
 			return
 		}
 
+		// Using the session pushed its expiry further, so the cookie needs
+		// to live longer as well (sliding renewal).
+		if session.Renewed {
+			setCookie(w, CookieSession, token, session.ExpiresAt)
+		}
+
 		// if a user has been found, get the Context set the value and
 		// UPDATE THE REQUEST with the new context.
 		ctx := r.Context()
@@ -294,3 +845,21 @@ func (umw UserMiddleWare) RequireUser(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequireVerifiedUser is like RequireUser, but also sends users who
+// haven't verified their email address yet to the verify email page.
+func (umw UserMiddleWare) RequireVerifiedUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+		if !user.EmailVerified() {
+			http.Redirect(w, r, "/verify-email", http.StatusFound)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
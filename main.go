@@ -5,10 +5,13 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/etaseq/lenslocked/controllers"
 	"github.com/etaseq/lenslocked/migrations"
 	"github.com/etaseq/lenslocked/models"
+	"github.com/etaseq/lenslocked/rand"
+	"github.com/etaseq/lenslocked/ratelimit"
 	"github.com/etaseq/lenslocked/templates"
 	"github.com/etaseq/lenslocked/views"
 	"github.com/go-chi/chi/v5"
@@ -26,6 +29,25 @@ type config struct {
 	Server struct {
 		Address string
 	}
+	Session struct {
+		Duration    time.Duration
+		IdleTimeout time.Duration
+	}
+	Cookie struct {
+		// Key signs cookies that must not be forged by the client, like
+		// the ones unlocking password protected galleries.
+		Key string
+	}
+	Images models.ImageStoreConfig
+	// Quota limits how much users can upload, no limits by default.
+	Quota models.Quota
+	// Passkeys are bound to the domain and origin the site is served from.
+	Passkey struct {
+		RPID   string
+		Origin string
+	}
+	// OIDC is an optional external identity provider to sign in with.
+	OIDC models.OIDCConfig
 }
 
 // A function to load ENV variables
@@ -57,9 +79,99 @@ func loadEnvConfig() (config, error) {
 	cfg.CSRF.Key = "VWNEO674goZGNWpw20t49v0n1984fcCE"
 	cfg.CSRF.Secure = false
 
+	// Session timeouts are optional, the SessionService has defaults.
+	if v := os.Getenv("SESSION_DURATION"); v != "" {
+		cfg.Session.Duration, err = time.ParseDuration(v)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	if v := os.Getenv("SESSION_IDLE_TIMEOUT"); v != "" {
+		cfg.Session.IdleTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	cfg.Cookie.Key = os.Getenv("COOKIE_KEY")
+	if cfg.Cookie.Key == "" {
+		// Without a key of its own, a random one is generated every time
+		// the server starts. That is fine for development, but signed
+		// cookies, like the ones unlocking galleries, stop working after
+		// a restart.
+		cfg.Cookie.Key, err = rand.String(32)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
 	// TODO: Read the server values from an ENV variable
 	cfg.Server.Address = ":3000"
 
+	cfg.Passkey.RPID = os.Getenv("PASSKEY_RP_ID")
+	if cfg.Passkey.RPID == "" {
+		cfg.Passkey.RPID = "localhost"
+	}
+	cfg.Passkey.Origin = os.Getenv("PASSKEY_ORIGIN")
+	if cfg.Passkey.Origin == "" {
+		cfg.Passkey.Origin = "http://localhost:3000"
+	}
+
+	// Signing in with an identity provider is only enabled when an issuer
+	// is set.
+	cfg.OIDC.Issuer = os.Getenv("OIDC_ISSUER")
+	cfg.OIDC.ID = os.Getenv("OIDC_PROVIDER")
+	if cfg.OIDC.ID == "" {
+		cfg.OIDC.ID = "oidc"
+	}
+	cfg.OIDC.Name = os.Getenv("OIDC_NAME")
+	if cfg.OIDC.Name == "" {
+		cfg.OIDC.Name = cfg.OIDC.ID
+	}
+	cfg.OIDC.ClientID = os.Getenv("OIDC_CLIENT_ID")
+	cfg.OIDC.ClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	cfg.OIDC.RedirectURL = os.Getenv("OIDC_REDIRECT_URL")
+	if cfg.OIDC.RedirectURL == "" {
+		cfg.OIDC.RedirectURL = "http://localhost:3000/oauth/" + cfg.OIDC.ID +
+			"/callback"
+	}
+
+	cfg.Images.Backend = os.Getenv("IMAGES_STORE")
+	cfg.Images.Dir = os.Getenv("IMAGES_DIR")
+	cfg.Images.S3.Endpoint = os.Getenv("S3_ENDPOINT")
+	cfg.Images.S3.Region = os.Getenv("S3_REGION")
+	cfg.Images.S3.Bucket = os.Getenv("S3_BUCKET")
+	cfg.Images.S3.AccessKey = os.Getenv("S3_ACCESS_KEY")
+	cfg.Images.S3.SecretKey = os.Getenv("S3_SECRET_KEY")
+
+	// Storage limits are in MB, images are counted.
+	if v := os.Getenv("QUOTA_USER_MB"); v != "" {
+		mb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Quota.UserBytes = mb << 20
+	}
+	if v := os.Getenv("QUOTA_USER_IMAGES"); v != "" {
+		cfg.Quota.UserImages, err = strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	if v := os.Getenv("QUOTA_GALLERY_MB"); v != "" {
+		mb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Quota.GalleryBytes = mb << 20
+	}
+	if v := os.Getenv("QUOTA_GALLERY_IMAGES"); v != "" {
+		cfg.Quota.GalleryImages, err = strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
 	return cfg, nil
 }
 
@@ -87,16 +199,73 @@ func main() {
 		DB: db,
 	}
 	sessionService := &models.SessionService{
-		DB: db,
+		DB:          db,
+		Duration:    cfg.Session.Duration,
+		IdleTimeout: cfg.Session.IdleTimeout,
 	}
 	pwResetService := &models.PasswordResetService{
 		DB: db,
 	}
+	emailVerificationService := &models.EmailVerificationService{
+		DB: db,
+	}
+	emailChangeService := &models.EmailChangeService{
+		DB: db,
+	}
+	twoFactorService := &models.TwoFactorService{
+		DB: db,
+	}
+	passkeyService := &models.PasskeyService{
+		DB:     db,
+		RPID:   cfg.Passkey.RPID,
+		RPName: "LensLocked",
+		Origin: cfg.Passkey.Origin,
+	}
+	magicLinkService := &models.MagicLinkService{
+		DB: db,
+	}
+	identityService := &models.IdentityService{
+		DB: db,
+	}
+	apiTokenService := &models.APITokenService{
+		DB: db,
+	}
+	oidcProviders := map[string]*models.OIDCProvider{}
+	if cfg.OIDC.Issuer != "" {
+		oidcProviders[cfg.OIDC.ID] = models.NewOIDCProvider(cfg.OIDC)
+	}
 	emailService := models.NewEmailService(cfg.SMTP)
+
+	imageStore, err := models.NewImageStore(cfg.Images)
+	if err != nil {
+		panic(err)
+	}
 	galleryService := &models.GalleryService{
-		DB: db,
+		DB:    db,
+		Store: imageStore,
+		Quota: cfg.Quota,
+	}
+	uploadService := &models.UploadService{
+		DB:    db,
+		Store: imageStore,
 	}
 
+	// Clean up expired sessions and tokens in the background
+	sweeper := &models.Sweeper{
+		Expirers: []models.Expirer{
+			sessionService,
+			pwResetService,
+			emailVerificationService,
+			emailChangeService,
+			magicLinkService,
+			apiTokenService,
+			uploadService,
+			passkeyService,
+		},
+	}
+	sweeper.Start()
+	defer sweeper.Stop()
+
 	// Setup middleware
 	umw := controllers.UserMiddleWare{
 		SessionService: sessionService,
@@ -118,10 +287,34 @@ func main() {
 
 	// Setup controllers
 	usersC := controllers.Users{
-		UserService:          userService,
-		SessionService:       sessionService,
-		PasswordResetService: pwResetService,
-		EmailService:         emailService,
+		UserService:              userService,
+		SessionService:           sessionService,
+		PasswordResetService:     pwResetService,
+		EmailVerificationService: emailVerificationService,
+		EmailChangeService:       emailChangeService,
+		TwoFactorService:         twoFactorService,
+		PasskeyService:           passkeyService,
+		MagicLinkService:         magicLinkService,
+		IdentityService:          identityService,
+		APITokenService:          apiTokenService,
+		EmailService:             emailService,
+		GalleryService:           galleryService,
+		OIDCProviders:            oidcProviders,
+		TwoFactorLimiter: &ratelimit.Limiter{
+			Max:    5,
+			Window: 15 * time.Minute,
+		},
+		SignInLimiter: &ratelimit.Limiter{
+			Max:       10,
+			Window:    15 * time.Minute,
+			BaseDelay: 250 * time.Millisecond,
+			MaxDelay:  4 * time.Second,
+		},
+		ResetLimiter: &ratelimit.Limiter{
+			Max:    5,
+			Window: time.Hour,
+		},
+		CookieKey: []byte(cfg.Cookie.Key),
 	}
 	usersC.Templates.New = views.Must(views.ParseFS(
 		templates.FS,
@@ -130,7 +323,7 @@ func main() {
 
 	usersC.Templates.SignIn = views.Must(views.ParseFS(
 		templates.FS,
-		"signin.html", "tailwind.html",
+		"signin.html", "passkey.html", "tailwind.html",
 	))
 
 	usersC.Templates.ForgotPassword = views.Must(views.ParseFS(
@@ -141,13 +334,55 @@ func main() {
 		templates.FS,
 		"check-your-email.html", "tailwind.html",
 	))
+	usersC.Templates.MagicLinkSent = views.Must(views.ParseFS(
+		templates.FS,
+		"magic-link-sent.html", "tailwind.html",
+	))
+	usersC.Templates.MagicLink = views.Must(views.ParseFS(
+		templates.FS,
+		"magic-link.html", "tailwind.html",
+	))
 	usersC.Templates.ResetPassword = views.Must(views.ParseFS(
 		templates.FS,
 		"reset-pw.html", "tailwind.html",
 	))
+	usersC.Templates.Sessions = views.Must(views.ParseFS(
+		templates.FS,
+		"sessions.html", "tailwind.html",
+	))
+	usersC.Templates.VerifyEmail = views.Must(views.ParseFS(
+		templates.FS,
+		"verify-email.html", "tailwind.html",
+	))
+	usersC.Templates.Settings = views.Must(views.ParseFS(
+		templates.FS,
+		"settings.html", "passkey.html", "tailwind.html",
+	))
+	usersC.Templates.TwoFactor = views.Must(views.ParseFS(
+		templates.FS,
+		"two-factor.html", "tailwind.html",
+	))
+	usersC.Templates.TwoFactorSetup = views.Must(views.ParseFS(
+		templates.FS,
+		"two-factor-setup.html", "tailwind.html",
+	))
+	usersC.Templates.RecoveryCodes = views.Must(views.ParseFS(
+		templates.FS,
+		"recovery-codes.html", "tailwind.html",
+	))
+
+	usersC.Templates.APIToken = views.Must(views.ParseFS(
+		templates.FS,
+		"api-token.html", "tailwind.html",
+	))
 
 	galleriesC := controllers.Galleries{
 		GalleryService: galleryService,
+		UnlockKey:      []byte(cfg.Cookie.Key),
+		UnlockLimiter: &ratelimit.Limiter{
+			Max:    5,
+			Window: 15 * time.Minute,
+		},
 	}
 	galleriesC.Templates.New = views.Must(views.ParseFS(
 		templates.FS,
@@ -165,6 +400,23 @@ func main() {
 		templates.FS,
 		"galleries/show.html", "tailwind.html",
 	))
+	galleriesC.Templates.ShowImage = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/image.html", "tailwind.html",
+	))
+	galleriesC.Templates.Unlock = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/unlock.html", "tailwind.html",
+	))
+	galleriesC.Templates.Search = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/search.html", "tailwind.html",
+	))
+
+	uploadsC := controllers.Uploads{
+		GalleryService: galleryService,
+		UploadService:  uploadService,
+	}
 
 	// Set up router and routes
 	r := chi.NewRouter()
@@ -180,43 +432,132 @@ func main() {
 
 	tpl = views.Must(views.ParseFS(templates.FS, "faq.html", "tailwind.html"))
 	r.Get("/faq", controllers.StaticHandler(tpl))
+	r.Get("/search", galleriesC.Search)
 
 	r.Get("/signup", usersC.New)
 	r.Post("/users", usersC.Create)
 	r.Get("/signin", usersC.SignIn)
 	r.Post("/signin", usersC.ProcessSignIn)
+	r.Get("/signin/2fa", usersC.TwoFactor)
+	r.Post("/signin/passkey/options", usersC.PasskeyRequestOptions)
+	r.Post("/signin/passkey", usersC.ProcessPasskeySignIn)
+	r.Post("/signin/link", usersC.ProcessMagicLink)
+	r.Get("/signin/link", usersC.MagicLink)
+	r.Post("/signin/link/verify", usersC.ProcessMagicLinkSignIn)
+	r.Post("/signin/2fa", usersC.ProcessTwoFactor)
+	r.Get("/oauth/{provider}", usersC.OIDCSignIn)
+	r.Get("/oauth/{provider}/callback", usersC.OIDCCallback)
 	r.Post("/signout", usersC.ProcessSignOut)
 	r.Get("/forgot-pw", usersC.ForgotPassword)
 	r.Post("/forgot-pw", usersC.ProcessForgotPassword)
 	r.Get("/reset-pw", usersC.ResetPassword)
 	r.Post("/reset-pw", usersC.ProcessResetPassword)
+	r.Get("/verify-email", usersC.VerifyEmail)
+	r.Get("/confirm-email", usersC.ConfirmEmail)
 	r.Route("/users/me", func(r chi.Router) {
 		r.Use(umw.RequireUser)
 		r.Get("/", usersC.CurrentUser)
+		r.Get("/sessions", usersC.Sessions)
+		r.Post("/sessions/{id}/delete", usersC.DeleteSession)
+		r.Post("/sessions/delete-others", usersC.DeleteOtherSessions)
+		r.Post("/verify-email", usersC.ResendVerificationEmail)
+		r.Get("/settings", usersC.Settings)
+		r.Post("/password", usersC.ProcessChangePassword)
+		r.Post("/email", usersC.ProcessChangeEmail)
+		r.Post("/2fa/setup", usersC.SetupTwoFactor)
+		r.Post("/2fa/enable", usersC.EnableTwoFactor)
+		r.Post("/2fa/disable", usersC.DisableTwoFactor)
+		r.Post("/2fa/recovery-codes", usersC.RegenerateRecoveryCodes)
+		r.Post("/passkeys/options", usersC.PasskeyCreationOptions)
+		r.Post("/passkeys", usersC.RegisterPasskey)
+		r.Post("/passkeys/{id}/delete", usersC.DeletePasskey)
+		r.Post("/identities/{provider}", usersC.LinkIdentity)
+		r.Post("/identities/{id}/delete", usersC.UnlinkIdentity)
+		r.Post("/api-tokens", usersC.CreateAPIToken)
+		r.Post("/api-tokens/{id}/delete", usersC.DeleteAPIToken)
 	})
 	r.Route("/galleries", func(r chi.Router) {
 		r.Get("/{id}", galleriesC.Show) // This route is visible for everyone
 		r.Get("/{id}/images/{filename}", galleriesC.Image)
+		r.Get("/{id}/images/{filename}/details", galleriesC.ShowImage)
+		r.Get("/{id}/download", galleriesC.Download)
+		r.Post("/{id}/unlock", galleriesC.Unlock)
 		r.Group(func(r chi.Router) {
 			r.Use(umw.RequireUser)
 			r.Get("/", galleriesC.Index)
-			r.Get("/new", galleriesC.New)
-			r.Post("/", galleriesC.Create) // The "/" route is the "/galleries"
+			// Only users with a verified email address can add content.
+			r.With(umw.RequireVerifiedUser).Get("/new", galleriesC.New)
+			r.With(umw.RequireVerifiedUser).Post("/", galleriesC.Create) // The "/" route is the "/galleries"
 			r.Get("/{id}/edit", galleriesC.Edit)
 			r.Post("/{id}", galleriesC.Update)
 			r.Post("/{id}/delete", galleriesC.Delete)
-			r.Post("/{id}/images", galleriesC.UploadImage)
+			r.Post("/{id}/password", galleriesC.UpdatePassword)
+			r.With(umw.RequireVerifiedUser).Post("/{id}/images", galleriesC.UploadImage)
+			r.With(umw.RequireVerifiedUser).Post("/{id}/images/zip", galleriesC.UploadZip)
+			r.Post("/{id}/images/order", galleriesC.ReorderImages)
+			r.Post("/{id}/images/{filename}", galleriesC.UpdateImage)
+			r.Post("/{id}/images/{filename}/cover", galleriesC.SetCover)
 			r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
+			// Resumable uploads, see controllers.Uploads.
+			r.Options("/{id}/uploads", uploadsC.Options)
+			r.With(umw.RequireVerifiedUser).Post("/{id}/uploads", uploadsC.Create)
+			r.Head("/{id}/uploads/{token}", uploadsC.Head)
+			r.Patch("/{id}/uploads/{token}", uploadsC.Patch)
+			r.Delete("/{id}/uploads/{token}", uploadsC.Delete)
 		})
 	})
 
+	// Unlisted galleries are shared using their slug instead of their ID.
+	r.Route("/g/{slug}", func(r chi.Router) {
+		r.Get("/", galleriesC.Show)
+		r.Get("/images/{filename}", galleriesC.Image)
+		r.Get("/images/{filename}/details", galleriesC.ShowImage)
+		r.Get("/download", galleriesC.Download)
+		r.Post("/unlock", galleriesC.Unlock)
+	})
+
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Page not found", http.StatusNotFound)
 	})
 
+	// The JSON API authenticates with API tokens instead of cookies, so it
+	// gets its own router without the CSRF and session middleware.
+	apiC := controllers.API{
+		GalleryService: galleryService,
+	}
+	tmw := controllers.TokenMiddleware{
+		APITokenService: apiTokenService,
+	}
+	read := tmw.RequireScope(models.ScopeGalleriesRead)
+	write := tmw.RequireScope(models.ScopeGalleriesWrite)
+	images := tmw.RequireScope(models.ScopeImagesWrite)
+	api := chi.NewRouter()
+	api.Use(tmw.SetUser)
+	api.Use(tmw.RequireUser)
+	api.Route("/galleries", func(r chi.Router) {
+		r.With(read).Get("/", apiC.Galleries)
+		r.With(write, apiC.RequireVerifiedUser).Post("/", apiC.CreateGallery)
+		r.With(read).Get("/{id}", apiC.Gallery)
+		r.With(write).Patch("/{id}", apiC.UpdateGallery)
+		r.With(write).Delete("/{id}", apiC.DeleteGallery)
+		r.With(images, apiC.RequireVerifiedUser).Post("/{id}/images", apiC.UploadImages)
+		r.With(read).Get("/{id}/images/{filename}", apiC.Image)
+		r.With(images).Delete("/{id}/images/{filename}", apiC.DeleteImage)
+		r.With(images).Options("/{id}/uploads", uploadsC.Options)
+		r.With(images, apiC.RequireVerifiedUser).Post("/{id}/uploads", uploadsC.Create)
+		r.With(images).Head("/{id}/uploads/{token}", uploadsC.Head)
+		r.With(images).Patch("/{id}/uploads/{token}", uploadsC.Patch)
+		r.With(images).Delete("/{id}/uploads/{token}", uploadsC.Delete)
+	})
+	api.NotFound(apiC.NotFound)
+
+	root := chi.NewRouter()
+	root.Mount("/api/v1", api)
+	root.Mount("/", r)
+
 	// Start the server
 	fmt.Printf("Starting the server on %s...\n", cfg.Server.Address)
-	err = http.ListenAndServe(cfg.Server.Address, r)
+	err = http.ListenAndServe(cfg.Server.Address, root)
 	if err != nil {
 		panic(err)
 	}
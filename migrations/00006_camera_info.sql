@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries
+  ADD COLUMN keep_camera_info BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE images
+  ADD COLUMN camera_make TEXT NOT NULL DEFAULT '',
+  ADD COLUMN camera_model TEXT NOT NULL DEFAULT '',
+  ADD COLUMN lens TEXT NOT NULL DEFAULT '',
+  ADD COLUMN exposure_time TEXT NOT NULL DEFAULT '',
+  ADD COLUMN f_number TEXT NOT NULL DEFAULT '',
+  ADD COLUMN iso TEXT NOT NULL DEFAULT '',
+  ADD COLUMN focal_length TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images
+  DROP COLUMN camera_make,
+  DROP COLUMN camera_model,
+  DROP COLUMN lens,
+  DROP COLUMN exposure_time,
+  DROP COLUMN f_number,
+  DROP COLUMN iso,
+  DROP COLUMN focal_length;
+
+ALTER TABLE galleries
+  DROP COLUMN keep_camera_info;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Existing galleries become private. Owners need to choose to share them
+-- again, instead of them staying readable by anyone guessing an ID.
+ALTER TABLE galleries
+  ADD COLUMN visibility TEXT NOT NULL DEFAULT 'private'
+    CHECK (visibility IN ('private', 'unlisted', 'public')),
+  ADD COLUMN share_slug TEXT UNIQUE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+  DROP COLUMN visibility,
+  DROP COLUMN share_slug;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- An empty password_hash means the gallery is not password protected.
+ALTER TABLE galleries
+  ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+  DROP COLUMN password_hash;
+-- +goose StatementEnd
@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Users can now be signed in on several devices at the same time, so a
+-- user can have many sessions.
+ALTER TABLE sessions
+  DROP CONSTRAINT sessions_user_id_key;
+
+ALTER TABLE sessions
+  ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  ADD COLUMN last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+  ADD COLUMN ip_address TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- Keep only the newest session of each user so the constraint can be
+-- added back.
+DELETE FROM sessions
+WHERE id NOT IN (SELECT MAX(id) FROM sessions GROUP BY user_id);
+
+ALTER TABLE sessions
+  DROP COLUMN created_at,
+  DROP COLUMN last_seen_at,
+  DROP COLUMN user_agent,
+  DROP COLUMN ip_address;
+
+ALTER TABLE sessions
+  ADD CONSTRAINT sessions_user_id_key UNIQUE (user_id);
+-- +goose StatementEnd
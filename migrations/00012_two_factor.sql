@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+-- totp_secret is set as soon as a user starts enrolling, but two-factor
+-- authentication is only enabled once totp_enabled_at is set.
+-- totp_last_step keeps a code from being used twice.
+ALTER TABLE users
+  ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '',
+  ADD COLUMN totp_enabled_at TIMESTAMPTZ,
+  ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_codes (
+  id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  code_hash TEXT NOT NULL,
+  used_at TIMESTAMPTZ,
+  UNIQUE (user_id, code_hash)
+);
+
+ALTER TABLE sessions
+  ADD COLUMN two_factor_pending BOOLEAN NOT NULL DEFAULT FALSE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE sessions
+  DROP COLUMN two_factor_pending;
+
+DROP TABLE recovery_codes;
+
+ALTER TABLE users
+  DROP COLUMN totp_secret,
+  DROP COLUMN totp_enabled_at,
+  DROP COLUMN totp_last_step;
+-- +goose StatementEnd
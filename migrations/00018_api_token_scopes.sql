@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Scopes are stored space separated, like OAuth scopes. Tokens created
+-- before scopes existed could do everything, so they keep every scope.
+ALTER TABLE api_tokens
+  ADD COLUMN scopes TEXT NOT NULL DEFAULT '',
+  ADD COLUMN expires_at TIMESTAMPTZ,
+  ADD COLUMN last_used_at TIMESTAMPTZ;
+UPDATE api_tokens
+SET scopes = 'galleries:read galleries:write images:write';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE api_tokens
+  DROP COLUMN scopes,
+  DROP COLUMN expires_at,
+  DROP COLUMN last_used_at;
+-- +goose StatementEnd
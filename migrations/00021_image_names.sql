@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE images
+  ADD COLUMN original_filename TEXT NOT NULL DEFAULT '',
+  ADD COLUMN content_hash TEXT,
+  ADD UNIQUE (gallery_id, content_hash);
+
+-- Images uploaded so far are stored under the name they were uploaded
+-- with.
+UPDATE images SET original_filename = filename;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images
+  DROP COLUMN original_filename,
+  DROP COLUMN content_hash;
+-- +goose StatementEnd
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Quotas add up the images of a user on every upload.
+CREATE INDEX images_user_id_idx ON images (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX images_user_id_idx;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE images
+  ADD COLUMN caption TEXT NOT NULL DEFAULT '',
+  ADD COLUMN alt_text TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE galleries
+  ADD COLUMN cover_image_id INT REFERENCES images (id) ON DELETE SET NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+  DROP COLUMN cover_image_id;
+
+ALTER TABLE images
+  DROP COLUMN caption,
+  DROP COLUMN alt_text;
+-- +goose StatementEnd
@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Tags are stored space separated, like the scopes of API tokens.
+ALTER TABLE galleries
+  ADD COLUMN description TEXT NOT NULL DEFAULT '',
+  ADD COLUMN tags TEXT NOT NULL DEFAULT '';
+
+-- Titles and tags weigh more than descriptions when ranking results.
+ALTER TABLE galleries
+  ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', title), 'A') ||
+    setweight(to_tsvector('english', tags), 'A') ||
+    setweight(to_tsvector('english', description), 'B')
+  ) STORED;
+CREATE INDEX galleries_search_vector_idx ON galleries USING GIN (search_vector);
+
+ALTER TABLE images
+  ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', caption), 'C')
+  ) STORED;
+CREATE INDEX images_search_vector_idx ON images USING GIN (search_vector);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images
+  DROP COLUMN search_vector;
+
+ALTER TABLE galleries
+  DROP COLUMN search_vector,
+  DROP COLUMN description,
+  DROP COLUMN tags;
+-- +goose StatementEnd
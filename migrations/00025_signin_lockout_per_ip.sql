@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Wrong passwords are counted per account and IP address, so guessing
+-- from one address can't lock the owner out everywhere else.
+CREATE TABLE signin_failures (
+  user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  ip TEXT NOT NULL,
+  failed_signins INT NOT NULL DEFAULT 0,
+  locked_until TIMESTAMPTZ,
+  PRIMARY KEY (user_id, ip)
+);
+ALTER TABLE users
+  DROP COLUMN failed_signins,
+  DROP COLUMN locked_until;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users
+  ADD COLUMN failed_signins INT NOT NULL DEFAULT 0,
+  ADD COLUMN locked_until TIMESTAMPTZ;
+DROP TABLE signin_failures;
+-- +goose StatementEnd
@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Challenges are single use. A row is kept until the challenge would have
+-- expired anyway, so a captured response can't be replayed.
+CREATE TABLE used_passkey_challenges (
+  challenge_hash TEXT PRIMARY KEY,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE used_passkey_challenges;
+-- +goose StatementEnd
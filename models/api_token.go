@@ -0,0 +1,273 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/etaseq/lenslocked/rand"
+)
+
+// APITokenPrefix starts every API token, which makes leaked tokens easy to
+// recognize, e.g. by secret scanners.
+const APITokenPrefix = "ll_"
+
+// The scopes an API token can be given. A token can only do what its
+// scopes allow, so a script that only downloads galleries can't delete
+// them.
+const (
+	ScopeGalleriesRead  = "galleries:read"
+	ScopeGalleriesWrite = "galleries:write"
+	ScopeImagesWrite    = "images:write"
+)
+
+// Scopes lists every scope, in the order they are shown to users.
+var Scopes = []string{
+	ScopeGalleriesRead,
+	ScopeGalleriesWrite,
+	ScopeImagesWrite,
+}
+
+const (
+	// How often the last_used_at of a token is updated. Scripts can send
+	// lots of requests, writing it on every single one would be a waste.
+	lastUsedInterval = time.Minute
+)
+
+// APIToken authenticates requests to the JSON API. Unlike sessions they
+// are created by the user for a specific app or script and last until
+// they expire or are revoked.
+type APIToken struct {
+	ID     int
+	UserID int
+	Name   string
+	// Token is only set when creating a new token. Just like sessions,
+	// only the hash is stored.
+	Token     string
+	TokenHash string
+	Scopes    []string
+	CreatedAt time.Time
+	// ExpiresAt is nil for tokens that never expire.
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+// HasScope reports whether the token was given scope.
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the token is past its expiry date.
+func (t APIToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+type APITokenService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when
+	// generating each token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will
+	// be used.
+	BytesPerToken int
+}
+
+// Create a new token for the user. expiresAt can be nil for a token that
+// never expires. It returns ErrInvalidScope if scopes is empty or has a
+// scope that isn't in Scopes.
+func (service *APITokenService) Create(userID int, name string,
+	scopes []string, expiresAt *time.Time) (*APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("create api token: name is required")
+	}
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+	token = APITokenPrefix + token
+
+	apiToken := APIToken{
+		UserID:    userID,
+		Name:      name,
+		Token:     token,
+		TokenHash: service.hash(token),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at;`, apiToken.UserID, apiToken.Name,
+		apiToken.TokenHash, strings.Join(apiToken.Scopes, " "),
+		apiToken.ExpiresAt)
+	err = row.Scan(&apiToken.ID, &apiToken.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+	return &apiToken, nil
+}
+
+// UserToken looks up a token and the user it belongs to. It returns
+// ErrNotFound if the token doesn't exist or was revoked, and
+// ErrTokenExpired if it is past its expiry date. Using a token updates
+// its LastUsedAt.
+func (service *APITokenService) UserToken(token string) (*User, *APIToken,
+	error) {
+	var user User
+	apiToken := APIToken{
+		Token:     token,
+		TokenHash: service.hash(token),
+	}
+	var scopes string
+	row := service.DB.QueryRow(`
+		SELECT api_tokens.id,
+			api_tokens.name,
+			api_tokens.scopes,
+			api_tokens.created_at,
+			api_tokens.expires_at,
+			api_tokens.last_used_at,
+			users.id,
+			users.email,
+			users.email_verified_at
+		FROM api_tokens
+			JOIN users ON users.id = api_tokens.user_id
+		WHERE api_tokens.token_hash = $1;`, apiToken.TokenHash)
+	err := row.Scan(&apiToken.ID, &apiToken.Name, &scopes,
+		&apiToken.CreatedAt, &apiToken.ExpiresAt, &apiToken.LastUsedAt,
+		&user.ID, &user.Email, &user.EmailVerifiedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("api token user: %w", err)
+	}
+	apiToken.UserID = user.ID
+	apiToken.Scopes = strings.Fields(scopes)
+
+	// Expired tokens are left for the Sweeper, so the user can still see
+	// in their settings which token stopped working.
+	if apiToken.Expired() {
+		return nil, nil, ErrTokenExpired
+	}
+
+	if apiToken.LastUsedAt == nil || time.Since(*apiToken.LastUsedAt) > lastUsedInterval {
+		row = service.DB.QueryRow(`
+			UPDATE api_tokens
+			SET last_used_at = now()
+			WHERE id = $1
+			RETURNING last_used_at;`, apiToken.ID)
+		err = row.Scan(&apiToken.LastUsedAt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("api token user: %w", err)
+		}
+	}
+
+	return &user, &apiToken, nil
+}
+
+// ByUserID returns the tokens of a user, newest first.
+func (service *APITokenService) ByUserID(userID int) ([]APIToken, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, name, token_hash, scopes, created_at, expires_at,
+			last_used_at
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query api tokens by user: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		token := APIToken{
+			UserID: userID,
+		}
+		var scopes string
+		err = rows.Scan(&token.ID, &token.Name, &token.TokenHash, &scopes,
+			&token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query api tokens by user: %w", err)
+		}
+		token.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("query api tokens by user: %w", err)
+	}
+	return tokens, nil
+}
+
+// Delete revokes one of the user's tokens.
+func (service *APITokenService) Delete(userID, id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM api_tokens
+		WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("delete api token: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired deletes tokens that expired more than a week ago. It is
+// run periodically by the Sweeper.
+func (service *APITokenService) DeleteExpired() (int64, error) {
+	result, err := service.DB.Exec(`
+		DELETE FROM api_tokens
+		WHERE expires_at < $1;`, time.Now().Add(-7*24*time.Hour))
+	if err != nil {
+		return 0, fmt.Errorf("delete expired api tokens: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired api tokens: %w", err)
+	}
+	return n, nil
+}
+
+func (service *APITokenService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// normalizeScopes checks scopes and returns them without duplicates, in the
+// order of Scopes.
+func normalizeScopes(scopes []string) ([]string, error) {
+	requested := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		if !contains(Scopes, scope) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+		}
+		requested[scope] = true
+	}
+	if len(requested) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidScope)
+	}
+
+	var normalized []string
+	for _, scope := range Scopes {
+		if requested[scope] {
+			normalized = append(normalized, scope)
+		}
+	}
+	return normalized, nil
+}
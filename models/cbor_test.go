@@ -0,0 +1,83 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	tests := map[string]struct {
+		data []byte
+		want interface{}
+	}{
+		"small int":    {[]byte{0x17}, int64(23)},
+		"uint16":       {[]byte{0x19, 0x01, 0x00}, int64(256)},
+		"negative int": {[]byte{0x38, 0x63}, int64(-100)},
+		"byte string":  {[]byte{0x43, 1, 2, 3}, []byte{1, 2, 3}},
+		"text string":  {[]byte{0x63, 'a', 'b', 'c'}, "abc"},
+		"array": {[]byte{0x83, 0x01, 0x20, 0xf5},
+			[]interface{}{int64(1), int64(-1), true}},
+		"map": {[]byte{0xa2, 0x01, 0x02, 0x61, 'k', 0xf6},
+			map[interface{}]interface{}{int64(1): int64(2), "k": nil}},
+		"half float": {[]byte{0xf9, 0x3c, 0x00}, float64(1)},
+		"tag":        {[]byte{0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0}, int64(1363896240)},
+		"nested arrays": {append(bytes.Repeat([]byte{0x81}, maxCBORDepth), 0x00),
+			nestedArrays(maxCBORDepth)},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, rest, err := decodeCBOR(append(tc.data, 0xff))
+			if err != nil {
+				t.Fatalf("decodeCBOR() err = %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("decodeCBOR() = %#v, want %#v", got, tc.want)
+			}
+			if !bytes.Equal(rest, []byte{0xff}) {
+				t.Errorf("decodeCBOR() rest = %x, want ff", rest)
+			}
+		})
+	}
+}
+
+// nestedArrays returns depth arrays nested in each other around a 0.
+func nestedArrays(depth int) interface{} {
+	var v interface{} = int64(0)
+	for i := 0; i < depth; i++ {
+		v = []interface{}{v}
+	}
+	return v
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":                   {},
+		"truncated uint16":        {0x19, 0x01},
+		"truncated uint64":        {0x1b, 0, 0, 0, 0},
+		"truncated byte string":   {0x45, 1, 2},
+		"truncated text string":   {0x65, 'a', 'b'},
+		"truncated array":         {0x83, 0x01, 0x02},
+		"map without value":       {0xa1, 0x01},
+		"truncated float":         {0xfb, 0, 0, 0},
+		"too deep":                append(bytes.Repeat([]byte{0x81}, maxCBORDepth+1), 0x00),
+		"over long byte string":   {0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"over long text string":   {0x7a, 0x7f, 0xff, 0xff, 0xff, 'a'},
+		"over long array":         {0x9a, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"over long map":           {0xbb, 0, 0, 0, 1, 0, 0, 0, 0, 0x01, 0x02},
+		"integer overflow":        {0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"negative overflow":       {0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"indefinite length array": {0x9f, 0x01, 0xff},
+		"byte string map key":     {0xa1, 0x41, 0x00, 0x01},
+		"unsupported simple":      {0xf0},
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := decodeCBOR(data)
+			if !errors.Is(err, errCBOR) {
+				t.Errorf("decodeCBOR(%x) err = %v, want errCBOR", data, err)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"fmt"
+	"html"
 
 	"github.com/go-mail/mail/v2"
 )
@@ -91,6 +92,88 @@ func (es *EmailService) ForgotPassword(to, resetURL string) error {
 	return nil
 }
 
+func (es *EmailService) MagicLink(to, signInURL string) error {
+	email := Email{
+		Subject: "Your sign in link",
+		To:      to,
+		Plaintext: "To sign in to LensLocked, please visit the following " +
+			"link: " + signInURL + "\n\nThe link expires shortly and can " +
+			"only be used once. If you didn't ask for it, you can ignore " +
+			"this email.",
+		HTML: `<p>To sign in to LensLocked, please visit the following link:
+			<a href="` + signInURL + `">` + signInURL + `</a></p>
+			<p>The link expires shortly and can only be used once. If you didn't
+			ask for it, you can ignore this email.</p>`,
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("magic link email: %w", err)
+	}
+
+	return nil
+}
+
+func (es *EmailService) VerifyEmail(to, verifyURL string) error {
+	email := Email{
+		Subject: "Verify your email address",
+		To:      to,
+		Plaintext: "Welcome to LensLocked! To verify your email address, " +
+			"please visit the following link: " + verifyURL,
+		HTML: `<p>Welcome to LensLocked! To verify your email address, please
+			visit the following link: <a href="` + verifyURL + `">` +
+			verifyURL + `</a></p>`,
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("verify email: %w", err)
+	}
+
+	return nil
+}
+
+func (es *EmailService) ConfirmEmailChange(to, confirmURL string) error {
+	email := Email{
+		Subject: "Confirm your new email address",
+		To:      to,
+		Plaintext: "To start using this email address with your LensLocked " +
+			"account, please visit the following link: " + confirmURL,
+		HTML: `<p>To start using this email address with your LensLocked
+			account, please visit the following link: <a href="` + confirmURL +
+			`">` + confirmURL + `</a></p>`,
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("confirm email change email: %w", err)
+	}
+
+	return nil
+}
+
+// EmailChanged lets the previous address of an account know that it is no
+// longer being used, in case someone else changed it.
+func (es *EmailService) EmailChanged(to, newEmail string) error {
+	email := Email{
+		Subject: "Your email address was changed",
+		To:      to,
+		Plaintext: "The email address of your LensLocked account was changed " +
+			"to " + newEmail + ". If you didn't do this, please contact " +
+			"support right away.",
+		HTML: `<p>The email address of your LensLocked account was changed to
+			` + html.EscapeString(newEmail) + `. If you didn't do this, please
+			contact support right away.</p>`,
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("email changed email: %w", err)
+	}
+
+	return nil
+}
+
 func (es *EmailService) setFrom(msg *mail.Message, email Email) {
 	var from string
 
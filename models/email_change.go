@@ -0,0 +1,174 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/etaseq/lenslocked/rand"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+const (
+	DefaultEmailChangeDuration = 24 * time.Hour
+)
+
+type EmailChange struct {
+	ID       int
+	UserID   int
+	NewEmail string
+	// Token is only set when an EmailChange is being created.
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+// EmailChangeService keeps track of requests to change the email address
+// of an account. The address is only changed once the user proves they
+// own the new one by following the link sent to it.
+type EmailChangeService struct {
+	DB *sql.DB
+	// Bytes per token is used to determine how many bytes to use when generating
+	// each email change token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be used.
+	BytesPerToken int
+	// Duration is the amount of time that an EmailChange is valid for.
+	// Defaults to DefaultEmailChangeDuration.
+	Duration time.Duration
+}
+
+// Create a request to change the email of the user to newEmail. Only the
+// latest request of a user can be confirmed.
+func (service *EmailChangeService) Create(userID int, newEmail string) (*EmailChange,
+	error) {
+	newEmail = strings.ToLower(newEmail)
+
+	// Catch addresses that are already taken early, instead of sending a
+	// confirmation link that can never work.
+	var taken bool
+	row := service.DB.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM users WHERE email = $1);`, newEmail)
+	err := row.Scan(&taken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	if taken {
+		return nil, ErrEmailTaken
+	}
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultEmailChangeDuration
+	}
+
+	change := EmailChange{
+		UserID:    userID,
+		NewEmail:  newEmail,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row = service.DB.QueryRow(`
+		INSERT INTO email_changes (user_id, new_email, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4) ON CONFLICT (user_id) DO
+		UPDATE
+		SET new_email = $2, token_hash = $3, expires_at = $4
+		RETURNING id;`, change.UserID, change.NewEmail, change.TokenHash,
+		change.ExpiresAt)
+	err = row.Scan(&change.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	return &change, nil
+}
+
+// Consume changes the email of the user the token belongs to. The new
+// address counts as verified since the token was sent to it. It returns
+// the updated user along with the email address it had before.
+func (service *EmailChangeService) Consume(token string) (*User, string, error) {
+	tokenHash := service.hash(token)
+	var user User
+	var change EmailChange
+	var oldEmail string
+
+	row := service.DB.QueryRow(`
+		SELECT email_changes.id,
+			email_changes.new_email,
+			email_changes.expires_at,
+			users.id,
+			users.email
+		FROM email_changes
+		JOIN users ON users.id = email_changes.user_id
+		WHERE email_changes.token_hash = $1;`, tokenHash)
+	err := row.Scan(&change.ID, &change.NewEmail, &change.ExpiresAt, &user.ID,
+		&oldEmail)
+	if err != nil {
+		return nil, "", fmt.Errorf("consume: %w", err)
+	}
+
+	if time.Now().After(change.ExpiresAt) {
+		return nil, "", fmt.Errorf("token expired: %v", token)
+	}
+
+	row = service.DB.QueryRow(`
+		UPDATE users
+		SET email = $2, email_verified_at = now()
+		WHERE id = $1
+		RETURNING email, email_verified_at;`, user.ID, change.NewEmail)
+	err = row.Scan(&user.Email, &user.EmailVerifiedAt)
+	if err != nil {
+		// Someone else could have signed up with the address in the meantime.
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			return nil, "", ErrEmailTaken
+		}
+		return nil, "", fmt.Errorf("consume: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+		DELETE FROM email_changes
+		WHERE id = $1;`, change.ID)
+	if err != nil {
+		return nil, "", fmt.Errorf("consume: %w", err)
+	}
+
+	return &user, oldEmail, nil
+}
+
+// DeleteExpired deletes the email changes that can no longer be
+// confirmed. It is run periodically by the Sweeper.
+func (service *EmailChangeService) DeleteExpired() (int64, error) {
+	result, err := service.DB.Exec(`
+		DELETE FROM email_changes
+		WHERE expires_at < $1;`, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("delete expired email changes: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired email changes: %w", err)
+	}
+	return n, nil
+}
+
+func (service *EmailChangeService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,155 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/etaseq/lenslocked/rand"
+)
+
+const (
+	DefaultVerificationDuration = 24 * time.Hour
+)
+
+type EmailVerification struct {
+	ID     int
+	UserID int
+	// Token is only set when an EmailVerification is being created.
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+// EmailVerificationService works exactly like the PasswordResetService,
+// except that consuming a token marks the user's email as verified.
+type EmailVerificationService struct {
+	DB *sql.DB
+	// Bytes per token is used to determine how many bytes to use when generating
+	// each verification token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be used.
+	BytesPerToken int
+	// Duration is the amount of time that an EmailVerification is valid for.
+	// Defaults to DefaultVerificationDuration.
+	Duration time.Duration
+}
+
+// Create a verification token for the user. Creating a new one replaces
+// any previous token, so only the link in the latest email works.
+func (service *EmailVerificationService) Create(userID int) (*EmailVerification,
+	error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultVerificationDuration
+	}
+
+	verification := EmailVerification{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row := service.DB.QueryRow(`
+		INSERT INTO email_verifications (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3) ON CONFLICT (user_id) DO
+		UPDATE
+		SET token_hash = $2, expires_at = $3
+		RETURNING id;`, verification.UserID, verification.TokenHash,
+		verification.ExpiresAt)
+	err = row.Scan(&verification.ID)
+
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	return &verification, nil
+}
+
+// Consume marks the email address of the token's user as verified and
+// deletes the token so that it can only be used once.
+func (service *EmailVerificationService) Consume(token string) (*User, error) {
+	tokenHash := service.hash(token)
+	var user User
+	var verification EmailVerification
+
+	row := service.DB.QueryRow(`
+		SELECT email_verifications.id,
+			email_verifications.expires_at,
+			users.id,
+			users.email
+		FROM email_verifications
+		JOIN users ON users.id = email_verifications.user_id
+		WHERE email_verifications.token_hash = $1;`, tokenHash)
+	err := row.Scan(&verification.ID, &verification.ExpiresAt, &user.ID,
+		&user.Email)
+
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+
+	if time.Now().After(verification.ExpiresAt) {
+		return nil, fmt.Errorf("token expired: %v", token)
+	}
+
+	row = service.DB.QueryRow(`
+		UPDATE users
+		SET email_verified_at = now()
+		WHERE id = $1
+		RETURNING email_verified_at;`, user.ID)
+	err = row.Scan(&user.EmailVerifiedAt)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+
+	err = service.delete(verification.ID)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+
+	return &user, nil
+}
+
+// DeleteExpired deletes the verification tokens that can no longer be
+// used. It is run periodically by the Sweeper.
+func (service *EmailVerificationService) DeleteExpired() (int64, error) {
+	result, err := service.DB.Exec(`
+		DELETE FROM email_verifications
+		WHERE expires_at < $1;`, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("delete expired email verifications: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired email verifications: %w", err)
+	}
+	return n, nil
+}
+
+func (service *EmailVerificationService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+func (service *EmailVerificationService) delete(id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM email_verifications
+		WHERE id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+
+	return nil
+}
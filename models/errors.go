@@ -11,6 +11,48 @@ import (
 var (
 	ErrNotFound   = errors.New("models: resource could not be found")
 	ErrEmailTaken = errors.New("models: email address is already in use")
+	// ErrWrongPassword is returned when a password doesn't match, for
+	// example when unlocking a password protected gallery.
+	ErrWrongPassword = errors.New("models: wrong password")
+	// ErrSessionExpired is returned when looking up a session that has
+	// reached its absolute lifetime or has been idle for too long.
+	ErrSessionExpired = errors.New("models: session has expired")
+	// ErrInvalidCode is returned when a two-factor or recovery code is
+	// wrong or has already been used.
+	ErrInvalidCode = errors.New("models: invalid two-factor code")
+	// ErrInvalidPasskey is returned when a passkey registration or sign in
+	// doesn't check out.
+	ErrInvalidPasskey = errors.New("models: passkey could not be verified")
+	// ErrAccountLocked is returned when signing in to an account that is
+	// temporarily locked after too many wrong passwords.
+	ErrAccountLocked = errors.New("models: account is temporarily locked")
+	// ErrInvalidIDToken is returned when an ID token from an OpenID
+	// Connect provider doesn't check out.
+	ErrInvalidIDToken = errors.New("models: invalid id token")
+	// ErrIdentityTaken is returned when linking an external account that
+	// is already linked to another user.
+	ErrIdentityTaken = errors.New("models: external account is already linked")
+	// ErrTokenExpired is returned when using an API token past its expiry
+	// date.
+	ErrTokenExpired = errors.New("models: api token has expired")
+	// ErrInvalidScope is returned when creating an API token with a scope
+	// that doesn't exist.
+	ErrInvalidScope = errors.New("models: invalid api token scope")
+	// ErrUploadTooLarge is returned when creating an upload longer than
+	// the UploadService MaxSize.
+	ErrUploadTooLarge = errors.New("models: upload is too large")
+	// ErrUploadOffset is returned when a chunk doesn't start where the
+	// upload left off.
+	ErrUploadOffset = errors.New("models: upload offset doesn't match")
+	// ErrUploadLocked is returned when locking an upload another request
+	// is already working on.
+	ErrUploadLocked = errors.New("models: upload is locked")
+	// ErrInvalidZip is returned when a bulk upload isn't a ZIP archive that
+	// can be read.
+	ErrInvalidZip = errors.New("models: invalid zip archive")
+	// ErrDuplicateImage is returned when uploading a file a gallery already
+	// has.
+	ErrDuplicateImage = errors.New("models: gallery already has this image")
 )
 
 type FileError struct {
@@ -22,23 +64,11 @@ func (fe FileError) Error() string {
 }
 
 func checkContentType(r io.ReadSeeker, allowedTypes []string) error {
-	// Read the first 512 bytes from the file
-	testBytes := make([]byte, 512)
-	_, err := r.Read(testBytes)
-	if err != nil {
-		return fmt.Errorf("checking content type: %w", err)
-	}
-
-	// Reset the file back to where it should be
-	_, err = r.Seek(0, 0)
+	contentType, err := detectContentType(r)
 	if err != nil {
 		return fmt.Errorf("checking content type: %w", err)
 	}
 
-	// Check the content types. Notice that the DetectContentType
-	// needs the first 512 bytes only and this is the reason I
-	// set the testBytes to the first 512 bytes of the file.
-	contentType := http.DetectContentType(testBytes)
 	for _, t := range allowedTypes {
 		if contentType == t {
 			return nil
@@ -49,6 +79,28 @@ func checkContentType(r io.ReadSeeker, allowedTypes []string) error {
 	}
 }
 
+// detectContentType sniffs the content type of r and resets it back to
+// the start so it can be read again.
+func detectContentType(r io.ReadSeeker) (string, error) {
+	// Read the first 512 bytes from the file
+	testBytes := make([]byte, 512)
+	n, err := io.ReadFull(r, testBytes)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", fmt.Errorf("detect content type: %w", err)
+	}
+
+	// Reset the file back to where it should be
+	_, err = r.Seek(0, 0)
+	if err != nil {
+		return "", fmt.Errorf("detect content type: %w", err)
+	}
+
+	// Notice that the DetectContentType needs the first 512 bytes only
+	// and this is the reason I set the testBytes to the first 512 bytes
+	// of the file.
+	return http.DetectContentType(testBytes[:n]), nil
+}
+
 func checkExtension(filename string, allowedExtensions []string) error {
 	// hasExtenstion function is from the gallery.go model
 	if hasExtension(filename, allowedExtensions) {
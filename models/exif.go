@@ -0,0 +1,469 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strings"
+)
+
+// CameraInfo is the subset of EXIF data that is safe to show publicly.
+// Everything else, most importantly GPS coordinates, is thrown away when
+// an image is uploaded.
+type CameraInfo struct {
+	Make         string
+	Model        string
+	Lens         string
+	ExposureTime string
+	FNumber      string
+	ISO          string
+	FocalLength  string
+}
+
+// IsZero reports whether no camera information is available.
+func (ci CameraInfo) IsZero() bool {
+	return ci == CameraInfo{}
+}
+
+// exifData is what I read from the EXIF block of an image before it is
+// stripped.
+type exifData struct {
+	Orientation int
+	Camera      CameraInfo
+}
+
+// stripMetadata removes EXIF, XMP, IPTC and text metadata from a JPEG or
+// PNG image. When the EXIF orientation says the image is stored rotated or
+// flipped, the pixels are transformed so the result displays correctly
+// without it. Other content types are returned untouched.
+func stripMetadata(data []byte, contentType string) ([]byte, exifData, error) {
+	var stripped []byte
+	var exif exifData
+	var err error
+
+	switch contentType {
+	case "image/jpeg":
+		stripped, exif, err = stripJPEG(data)
+	case "image/png":
+		stripped, exif, err = stripPNG(data)
+	default:
+		return data, exifData{}, nil
+	}
+	if err != nil {
+		return nil, exifData{}, fmt.Errorf("strip metadata: %w", err)
+	}
+
+	// Fixing the orientation decodes the whole image, so the dimensions
+	// have to be checked first. The header is enough for that.
+	config, _, err := image.DecodeConfig(bytes.NewReader(stripped))
+	if err != nil {
+		return nil, exifData{}, FileError{
+			Issue: fmt.Sprintf("unable to decode image: %v", err),
+		}
+	}
+	err = checkPixels(config.Width, config.Height)
+	if err != nil {
+		return nil, exifData{}, err
+	}
+
+	if exif.Orientation > 1 && exif.Orientation <= 8 {
+		stripped, err = applyOrientation(stripped, contentType, exif.Orientation)
+		if err != nil {
+			return nil, exifData{}, fmt.Errorf("strip metadata: %w", err)
+		}
+	}
+	return stripped, exif, nil
+}
+
+// stripJPEG copies every segment of a JPEG except the ones that can hold
+// metadata. APP0 (JFIF), APP2 (ICC color profile) and APP14 (Adobe color
+// transform) are kept because they change how the image is displayed.
+func stripJPEG(data []byte) ([]byte, exifData, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, exifData{}, FileError{Issue: "malformed jpeg"}
+	}
+
+	var exif exifData
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return nil, exifData{}, FileError{Issue: "malformed jpeg"}
+		}
+		marker := data[i+1]
+		// Markers can be padded with any number of 0xFF bytes.
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		// Start of scan: everything after this is image data.
+		if marker == 0xDA {
+			out.Write(data[i:])
+			return out.Bytes(), exif, nil
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, exifData{}, FileError{Issue: "malformed jpeg"}
+		}
+		payload := data[i+4 : end]
+
+		if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			exif = parseExif(payload[6:])
+		}
+		if keepJPEGSegment(marker) {
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	return nil, exifData{}, FileError{Issue: "malformed jpeg"}
+}
+
+func keepJPEGSegment(marker byte) bool {
+	switch {
+	case marker == 0xE0, marker == 0xE2, marker == 0xEE:
+		return true
+	// The rest of the APPn segments (EXIF, XMP, IPTC, ...) and comments.
+	case marker >= 0xE1 && marker <= 0xEF, marker == 0xFE:
+		return false
+	default:
+		return true
+	}
+}
+
+// stripPNG only keeps the chunks needed to display the image correctly,
+// dropping text chunks, timestamps and EXIF.
+func stripPNG(data []byte) ([]byte, exifData, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, exifData{}, FileError{Issue: "malformed png"}
+	}
+	keep := map[string]bool{
+		"IHDR": true, "PLTE": true, "IDAT": true, "IEND": true,
+		"tRNS": true, "gAMA": true, "cHRM": true, "sRGB": true,
+		"iCCP": true, "sBIT": true, "bKGD": true, "pHYs": true,
+	}
+
+	var exif exifData
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.WriteString(signature)
+
+	i := len(signature)
+	for i+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		// 4 bytes length, 4 bytes type, the data and a 4 bytes CRC.
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, exifData{}, FileError{Issue: "malformed png"}
+		}
+		chunkType := string(data[i+4 : i+8])
+
+		if chunkType == "eXIf" {
+			exif = parseExif(data[i+8 : i+8+length])
+		}
+		if keep[chunkType] {
+			out.Write(data[i:end])
+		}
+		i = end
+		if chunkType == "IEND" {
+			return out.Bytes(), exif, nil
+		}
+	}
+	return nil, exifData{}, FileError{Issue: "malformed png"}
+}
+
+// parseExif reads the orientation and camera details from a TIFF
+// structured EXIF block. EXIF data found in the wild is often broken, so
+// anything that can't be read is simply left empty.
+func parseExif(tiff []byte) exifData {
+	var exif exifData
+	if len(tiff) < 8 {
+		return exif
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return exif
+	}
+	r := tiffReader{data: tiff, order: order}
+
+	ifd0 := r.entries(order.Uint32(tiff[4:]))
+	if v, ok := ifd0[0x0112]; ok {
+		exif.Orientation = int(r.uint(v))
+	}
+	exif.Camera.Make = r.ascii(ifd0[0x010F])
+	exif.Camera.Model = r.ascii(ifd0[0x0110])
+
+	exifIFD, ok := ifd0[0x8769]
+	if !ok {
+		return exif
+	}
+	sub := r.entries(uint32(r.uint(exifIFD)))
+	exif.Camera.Lens = r.ascii(sub[0xA434])
+	if v, ok := sub[0x829A]; ok {
+		exif.Camera.ExposureTime = formatExposure(r.rational(v))
+	}
+	if v, ok := sub[0x829D]; ok {
+		if f := r.rational(v); f > 0 {
+			exif.Camera.FNumber = "f/" + trimFloat(f)
+		}
+	}
+	if v, ok := sub[0x8827]; ok {
+		if iso := r.uint(v); iso > 0 {
+			exif.Camera.ISO = fmt.Sprintf("ISO %d", iso)
+		}
+	}
+	if v, ok := sub[0x920A]; ok {
+		if fl := r.rational(v); fl > 0 {
+			exif.Camera.FocalLength = trimFloat(fl) + "mm"
+		}
+	}
+	return exif
+}
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	// value holds the 4 byte value/offset field of the entry.
+	value []byte
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func (r tiffReader) entries(offset uint32) map[uint16]tiffEntry {
+	entries := make(map[uint16]tiffEntry)
+	if int(offset)+2 > len(r.data) {
+		return entries
+	}
+	n := int(r.order.Uint16(r.data[offset:]))
+	for i := 0; i < n; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(r.data) {
+			break
+		}
+		entry := r.data[start : start+12]
+		entries[r.order.Uint16(entry)] = tiffEntry{
+			typ:   r.order.Uint16(entry[2:]),
+			count: r.order.Uint32(entry[4:]),
+			value: entry[8:12],
+		}
+	}
+	return entries
+}
+
+// bytes returns the data of an entry, following the offset when the value
+// doesn't fit inside the entry itself.
+func (r tiffReader) bytes(e tiffEntry) []byte {
+	sizes := map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+	size, ok := sizes[e.typ]
+	if !ok || e.count == 0 || e.count > 1<<16 {
+		return nil
+	}
+	total := size * int(e.count)
+	if total <= 4 {
+		return e.value[:total]
+	}
+	offset := int(r.order.Uint32(e.value))
+	if offset+total > len(r.data) {
+		return nil
+	}
+	return r.data[offset : offset+total]
+}
+
+func (r tiffReader) uint(e tiffEntry) uint32 {
+	b := r.bytes(e)
+	switch {
+	case e.typ == 3 && len(b) >= 2:
+		return uint32(r.order.Uint16(b))
+	case (e.typ == 4 || e.typ == 9) && len(b) >= 4:
+		return r.order.Uint32(b)
+	}
+	return 0
+}
+
+func (r tiffReader) rational(e tiffEntry) float64 {
+	b := r.bytes(e)
+	if (e.typ != 5 && e.typ != 10) || len(b) < 8 {
+		return 0
+	}
+	num, den := r.order.Uint32(b), r.order.Uint32(b[4:])
+	if den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+func (r tiffReader) ascii(e tiffEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(r.bytes(e)), "\x00"))
+}
+
+func formatExposure(seconds float64) string {
+	switch {
+	case seconds <= 0:
+		return ""
+	case seconds < 1:
+		return fmt.Sprintf("1/%ds", int(math.Round(1/seconds)))
+	default:
+		return trimFloat(seconds) + "s"
+	}
+}
+
+func trimFloat(f float64) string {
+	return strings.TrimSuffix(strings.TrimRight(fmt.Sprintf("%.1f", f), "0"), ".")
+}
+
+// applyOrientation decodes the image, rotates and/or flips it according
+// to the EXIF orientation and encodes it again. The encoders in the
+// standard library don't write color profiles, so the ones found in data
+// are copied over to the result.
+func applyOrientation(data []byte, contentType string, orientation int) ([]byte,
+	error) {
+	profile := colorProfile(data, contentType)
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("apply orientation: %w", err)
+	}
+
+	// Work on plain RGBA pixels so they can be copied around directly.
+	b := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // flipped horizontally
+				sx, sy = w-1-x, y
+			case 3: // rotated 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // flipped vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs a 90° clockwise rotation
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs a 90° counter clockwise rotation
+				sx, sy = w-1-y, x
+			}
+			si := rgba.PixOffset(sx, sy)
+			di := dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], rgba.Pix[si:si+4])
+		}
+	}
+
+	var buf bytes.Buffer
+	switch contentType {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 92})
+	case "image/png":
+		err = png.Encode(&buf, dst)
+	default:
+		err = errors.New("unsupported content type " + contentType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("apply orientation: %w", err)
+	}
+	return insertColorProfile(buf.Bytes(), contentType, profile), nil
+}
+
+// colorProfile returns the raw segments (JPEG) or chunks (PNG) of an image
+// that describe its color space, ready to be copied into another image
+// of the same type.
+func colorProfile(data []byte, contentType string) []byte {
+	var profile []byte
+	switch contentType {
+	case "image/jpeg":
+		// data went through stripJPEG already, so the segments are well
+		// formed up to the start of scan.
+		for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+			marker := data[i+1]
+			if marker == 0xDA {
+				break
+			}
+			end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+			if end > len(data) {
+				break
+			}
+			if marker == 0xE2 &&
+				bytes.HasPrefix(data[i+4:end], []byte("ICC_PROFILE\x00")) {
+				profile = append(profile, data[i:end]...)
+			}
+			i = end
+		}
+	case "image/png":
+		// Color chunks must come before the image data.
+		for i := 8; i+12 <= len(data); {
+			end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+			if end > len(data) {
+				break
+			}
+			switch string(data[i+4 : i+8]) {
+			case "iCCP", "sRGB", "gAMA", "cHRM":
+				profile = append(profile, data[i:end]...)
+			case "IDAT":
+				return profile
+			}
+			i = end
+		}
+	}
+	return profile
+}
+
+// insertColorProfile adds the profile returned by colorProfile to an image
+// produced by the standard library encoders. For a JPEG it goes right
+// after the start of image marker, for a PNG right after the IHDR chunk.
+func insertColorProfile(data []byte, contentType string, profile []byte) []byte {
+	if len(profile) == 0 {
+		return data
+	}
+
+	var at int
+	switch contentType {
+	case "image/jpeg":
+		at = 2
+	case "image/png":
+		// The signature and the 13 bytes IHDR chunk.
+		at = 8 + 12 + 13
+	default:
+		return data
+	}
+	if at > len(data) {
+		return data
+	}
+
+	out := make([]byte, 0, len(data)+len(profile))
+	out = append(out, data[:at]...)
+	out = append(out, profile...)
+	return append(out, data[at:]...)
+}
@@ -0,0 +1,422 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+	"testing"
+)
+
+// tiffTag is an entry of an IFD. data is the value already encoded in the
+// byte order of the TIFF block.
+type tiffTag struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+// tiffOrder is implemented by binary.BigEndian and binary.LittleEndian.
+type tiffOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// buildTIFF returns a TIFF structured EXIF block with the given IFD0
+// entries and, unless exif is nil, an EXIF sub-IFD linked from IFD0.
+func buildTIFF(order tiffOrder, ifd0, exif []tiffTag) []byte {
+	if exif != nil {
+		ifd0 = append(ifd0, tiffTag{tag: 0x8769, typ: 4, count: 1})
+	}
+	ifdSize := func(n int) int { return 2 + 12*n + 4 }
+	exifOffset := 8 + ifdSize(len(ifd0))
+	size := exifOffset
+	if exif != nil {
+		size += ifdSize(len(exif))
+	}
+
+	out := make([]byte, size)
+	copy(out, "MM")
+	if order == binary.LittleEndian {
+		copy(out, "II")
+	}
+	order.PutUint16(out[2:], 42)
+	order.PutUint32(out[4:], 8)
+	writeIFD := func(at int, tags []tiffTag) {
+		order.PutUint16(out[at:], uint16(len(tags)))
+		for i, tag := range tags {
+			data := tag.data
+			if tag.tag == 0x8769 {
+				data = order.AppendUint32(nil, uint32(exifOffset))
+			}
+			entry := out[at+2+i*12 : at+14+i*12]
+			order.PutUint16(entry, tag.tag)
+			order.PutUint16(entry[2:], tag.typ)
+			order.PutUint32(entry[4:], tag.count)
+			if len(data) <= 4 {
+				copy(entry[8:], data)
+				continue
+			}
+			order.PutUint32(entry[8:], uint32(len(out)))
+			out = append(out, data...)
+		}
+	}
+	writeIFD(8, ifd0)
+	if exif != nil {
+		writeIFD(exifOffset, exif)
+	}
+	return out
+}
+
+func asciiTag(tag uint16, s string) tiffTag {
+	return tiffTag{tag: tag, typ: 2, count: uint32(len(s) + 1), data: []byte(s + "\x00")}
+}
+
+func shortTag(order tiffOrder, tag, v uint16) tiffTag {
+	return tiffTag{tag: tag, typ: 3, count: 1, data: order.AppendUint16(nil, v)}
+}
+
+func rationalTag(order tiffOrder, tag uint16, num, den uint32) tiffTag {
+	return tiffTag{tag: tag, typ: 5, count: 1,
+		data: order.AppendUint32(order.AppendUint32(nil, num), den)}
+}
+
+// testExif returns an EXIF block with an orientation, camera details and
+// GPS coordinates.
+func testExif(order tiffOrder, orientation uint16) []byte {
+	return buildTIFF(order, []tiffTag{
+		asciiTag(0x010F, "Canon"),
+		asciiTag(0x0110, "Canon EOS R5"),
+		shortTag(order, 0x0112, orientation),
+		// A GPS IFD pointer, which must never make it into the result.
+		{tag: 0x8825, typ: 4, count: 1, data: order.AppendUint32(nil, 0)},
+	}, []tiffTag{
+		rationalTag(order, 0x829A, 1, 250),
+		rationalTag(order, 0x829D, 28, 10),
+		shortTag(order, 0x8827, 400),
+		rationalTag(order, 0x920A, 50, 1),
+		asciiTag(0xA434, "RF 50mm F1.8 STM"),
+	})
+}
+
+var testCamera = CameraInfo{
+	Make:         "Canon",
+	Model:        "Canon EOS R5",
+	Lens:         "RF 50mm F1.8 STM",
+	ExposureTime: "1/250s",
+	FNumber:      "f/2.8",
+	ISO:          "ISO 400",
+	FocalLength:  "50mm",
+}
+
+func TestParseExif(t *testing.T) {
+	tests := map[string]struct {
+		tiff []byte
+		want exifData
+	}{
+		"big endian": {
+			testExif(binary.BigEndian, 6),
+			exifData{Orientation: 6, Camera: testCamera},
+		},
+		"little endian": {
+			testExif(binary.LittleEndian, 3),
+			exifData{Orientation: 3, Camera: testCamera},
+		},
+		"long exposure": {
+			buildTIFF(binary.BigEndian, nil, []tiffTag{
+				rationalTag(binary.BigEndian, 0x829A, 5, 2),
+			}),
+			exifData{Camera: CameraInfo{ExposureTime: "2.5s"}},
+		},
+		"no exif sub-ifd": {
+			buildTIFF(binary.BigEndian, []tiffTag{
+				asciiTag(0x010F, "  Nikon  "),
+			}, nil),
+			exifData{Camera: CameraInfo{Make: "Nikon"}},
+		},
+		"zero denominator": {
+			buildTIFF(binary.BigEndian, nil, []tiffTag{
+				rationalTag(binary.BigEndian, 0x829D, 28, 0),
+			}),
+			exifData{},
+		},
+		"value offset out of bounds": {
+			buildTIFF(binary.BigEndian, []tiffTag{
+				{tag: 0x010F, typ: 2, count: 100, data: []byte{0, 0, 0xff, 0xff}},
+			}, nil),
+			exifData{},
+		},
+		"ifd offset out of bounds": {
+			[]byte("MM\x00\x2a\x00\x00\xff\xff"),
+			exifData{},
+		},
+		"unknown byte order": {
+			[]byte("XX\x00\x2a\x00\x00\x00\x08\x00\x00"),
+			exifData{},
+		},
+		"too short": {[]byte("MM\x00\x2a"), exifData{}},
+		"empty":     {nil, exifData{}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := parseExif(tc.tiff)
+			if got != tc.want {
+				t.Errorf("parseExif() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+// testPixel is the color of the pixel at x, y of the images built by
+// testImage, so it can be told where a pixel ended up.
+func testPixel(x, y int) color.NRGBA {
+	return color.NRGBA{R: uint8(50 + 100*x), G: uint8(40 + 80*y), B: 10, A: 255}
+}
+
+// testImage returns a 2x3 image with a different color for every pixel.
+func testImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 3))
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 2; x++ {
+			img.Set(x, y, testPixel(x, y))
+		}
+	}
+	return img
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk,
+		crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// testPNG returns a PNG of testImage with chunks inserted after IHDR.
+func testPNG(t *testing.T, chunks ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := png.Encode(&buf, testImage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The signature and the 13 bytes IHDR chunk.
+	const at = 8 + 12 + 13
+	data := buf.Bytes()
+	out := append([]byte(nil), data[:at]...)
+	for _, chunk := range chunks {
+		out = append(out, chunk...)
+	}
+	return append(out, data[at:]...)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// testJPEG returns a JPEG of testImage with segments inserted after the
+// start of image marker.
+func testJPEG(t *testing.T, segments ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	out := append([]byte(nil), data[:2]...)
+	for _, segment := range segments {
+		out = append(out, segment...)
+	}
+	return append(out, data[2:]...)
+}
+
+// pngChunkTypes returns the types of the chunks of a PNG in order.
+func pngChunkTypes(data []byte) []string {
+	var types []string
+	for i := 8; i+12 <= len(data); {
+		types = append(types, string(data[i+4:i+8]))
+		i += 12 + int(binary.BigEndian.Uint32(data[i:]))
+	}
+	return types
+}
+
+// jpegMarkers returns the markers of a JPEG up to the start of scan.
+func jpegMarkers(data []byte) []byte {
+	var markers []byte
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		markers = append(markers, data[i+1])
+		if data[i+1] == 0xDA {
+			break
+		}
+		i += 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+	}
+	return markers
+}
+
+func TestStripMetadataPNG(t *testing.T) {
+	data := testPNG(t,
+		pngChunk("tEXt", []byte("Comment\x00taken at home")),
+		pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>")),
+		pngChunk("tIME", []byte{0x07, 0xe8, 1, 2, 3, 4, 5}),
+		pngChunk("gAMA", binary.BigEndian.AppendUint32(nil, 45455)),
+		pngChunk("eXIf", testExif(binary.BigEndian, 1)))
+
+	stripped, exif, err := stripMetadata(data, "image/png")
+	if err != nil {
+		t.Fatalf("stripMetadata() err = %v", err)
+	}
+	if exif.Camera != testCamera {
+		t.Errorf("Camera = %+v, want %+v", exif.Camera, testCamera)
+	}
+	for _, typ := range pngChunkTypes(stripped) {
+		switch typ {
+		case "tEXt", "iTXt", "zTXt", "tIME", "eXIf":
+			t.Errorf("stripped image has a %v chunk", typ)
+		}
+	}
+	if !bytes.Contains(stripped, pngChunk("gAMA",
+		binary.BigEndian.AppendUint32(nil, 45455))) {
+		t.Errorf("stripped image lost its gAMA chunk")
+	}
+	if !bytes.Equal(stripped, testPNG(t, pngChunk("gAMA",
+		binary.BigEndian.AppendUint32(nil, 45455)))) {
+		t.Errorf("stripped image changed more than the metadata")
+	}
+}
+
+func TestStripMetadataJPEG(t *testing.T) {
+	exifSegment := jpegSegment(0xE1, append([]byte("Exif\x00\x00"),
+		testExif(binary.LittleEndian, 1)...))
+	icc := jpegSegment(0xE2, []byte("ICC_PROFILE\x00\x01\x01profile"))
+	data := testJPEG(t,
+		exifSegment,
+		jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")),
+		icc,
+		jpegSegment(0xED, []byte("Photoshop 3.0\x00IPTC")),
+		jpegSegment(0xFE, []byte("taken at home")))
+
+	stripped, exif, err := stripMetadata(data, "image/jpeg")
+	if err != nil {
+		t.Fatalf("stripMetadata() err = %v", err)
+	}
+	if exif.Camera != testCamera {
+		t.Errorf("Camera = %+v, want %+v", exif.Camera, testCamera)
+	}
+	for _, marker := range jpegMarkers(stripped) {
+		if (marker >= 0xE1 && marker <= 0xEF && marker != 0xE2 &&
+			marker != 0xEE) || marker == 0xFE {
+			t.Errorf("stripped image has a %X segment", marker)
+		}
+	}
+	if !bytes.Contains(stripped, icc) {
+		t.Errorf("stripped image lost its color profile")
+	}
+	if !bytes.Equal(stripped, testJPEG(t, icc)) {
+		t.Errorf("stripped image changed more than the metadata")
+	}
+}
+
+func TestStripMetadataOrientation(t *testing.T) {
+	// Where the top left and top right pixels of the displayed image come
+	// from in the stored 2x3 image.
+	type point struct{ x, y int }
+	tests := map[int]struct {
+		width, height     int
+		topLeft, topRight point
+	}{
+		1: {2, 3, point{0, 0}, point{1, 0}},
+		2: {2, 3, point{1, 0}, point{0, 0}},
+		3: {2, 3, point{1, 2}, point{0, 2}},
+		4: {2, 3, point{0, 2}, point{1, 2}},
+		5: {3, 2, point{0, 0}, point{0, 2}},
+		6: {3, 2, point{0, 2}, point{0, 0}},
+		7: {3, 2, point{1, 2}, point{1, 0}},
+		8: {3, 2, point{1, 0}, point{1, 2}},
+	}
+	for orientation, tc := range tests {
+		t.Run(strconv.Itoa(orientation), func(t *testing.T) {
+			data := testPNG(t, pngChunk("eXIf",
+				testExif(binary.BigEndian, uint16(orientation))))
+			stripped, exif, err := stripMetadata(data, "image/png")
+			if err != nil {
+				t.Fatalf("stripMetadata() err = %v", err)
+			}
+			if exif.Orientation != orientation {
+				t.Errorf("Orientation = %d, want %d", exif.Orientation, orientation)
+			}
+			img, err := png.Decode(bytes.NewReader(stripped))
+			if err != nil {
+				t.Fatalf("png.Decode() err = %v", err)
+			}
+			b := img.Bounds()
+			if b.Dx() != tc.width || b.Dy() != tc.height {
+				t.Fatalf("size = %dx%d, want %dx%d", b.Dx(), b.Dy(),
+					tc.width, tc.height)
+			}
+			corners := map[point]point{
+				{0, 0}:            tc.topLeft,
+				{tc.width - 1, 0}: tc.topRight,
+			}
+			for at, from := range corners {
+				got := color.NRGBAModel.Convert(img.At(at.x, at.y))
+				if got != testPixel(from.x, from.y) {
+					t.Errorf("pixel %v = %v, want the one from %v", at, got, from)
+				}
+			}
+		})
+	}
+
+	t.Run("jpeg", func(t *testing.T) {
+		data := testJPEG(t, jpegSegment(0xE1, append([]byte("Exif\x00\x00"),
+			testExif(binary.BigEndian, 6)...)))
+		stripped, _, err := stripMetadata(data, "image/jpeg")
+		if err != nil {
+			t.Fatalf("stripMetadata() err = %v", err)
+		}
+		config, err := jpeg.DecodeConfig(bytes.NewReader(stripped))
+		if err != nil {
+			t.Fatalf("jpeg.DecodeConfig() err = %v", err)
+		}
+		if config.Width != 3 || config.Height != 2 {
+			t.Errorf("size = %dx%d, want 3x2", config.Width, config.Height)
+		}
+	})
+}
+
+func TestStripMetadataMalformed(t *testing.T) {
+	validPNG := testPNG(t)
+	validJPEG := testJPEG(t)
+	tests := map[string]struct {
+		data        []byte
+		contentType string
+	}{
+		"png without signature": {validPNG[8:], "image/png"},
+		"png without IEND":      {validPNG[:len(validPNG)-12], "image/png"},
+		"png chunk too long": {append(validPNG[:33:33],
+			0x7f, 0xff, 0xff, 0xff, 'I', 'D', 'A', 'T', 0, 0, 0, 0), "image/png"},
+		"jpeg without SOI":           {validJPEG[2:], "image/jpeg"},
+		"jpeg without start of scan": {validJPEG[:20], "image/jpeg"},
+		"jpeg segment too long": {append([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0xff, 0xff},
+			validJPEG[2:20]...), "image/jpeg"},
+		"jpeg garbage between segments": {append([]byte{0xFF, 0xD8, 0x00},
+			validJPEG[2:]...), "image/jpeg"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := stripMetadata(tc.data, tc.contentType)
+			var fileErr FileError
+			if !errors.As(err, &fileErr) {
+				t.Errorf("stripMetadata() err = %v, want a FileError", err)
+			}
+		})
+	}
+}
@@ -1,47 +1,156 @@
 package models
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
-	"io/fs"
-	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/etaseq/lenslocked/rand"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Image struct {
+	ID        int
 	GalleryID int
-	Path      string
-	Filename  string
+	// Path is the key of the image inside the ImageStore,
+	// e.g. "gallery-2/3q2-7wEjyTB1hYYT.jpg".
+	Path string
+	// Filename is generated when the image is uploaded, so two uploads
+	// with the same name can't replace each other. It identifies the
+	// image in URLs and in the ImageStore.
+	Filename string
+	// OriginalFilename is the name the image was uploaded with, which is
+	// what users get to see.
+	OriginalFilename string
+	// ContentHash is the hex encoded SHA-256 of the uploaded file, used to
+	// detect the same file being uploaded to a gallery twice. It is empty
+	// for images that were added by ReconcileImages.
+	ContentHash string
+	ContentType string
+	Bytes       int64
+	Width       int
+	Height      int
+	// UserID is the user who uploaded the image.
+	UserID    int
+	CreatedAt time.Time
+	// Position is used to order the images of a gallery.
+	Position int
+	// Caption is shown below the image and AltText describes it for
+	// people who can't see it. Both are optional.
+	Caption string
+	AltText string
+	// Camera is only filled in when the gallery keeps camera info.
+	Camera CameraInfo
 }
 
+const (
+	// Only the owner can see a private gallery.
+	VisibilityPrivate = "private"
+	// Unlisted galleries can be seen by anyone who has the share link,
+	// which uses the unguessable ShareSlug instead of the gallery ID.
+	VisibilityUnlisted = "unlisted"
+	// Public galleries can be seen by anyone.
+	VisibilityPublic = "public"
+
+	// The number of random bytes used to generate a gallery's ShareSlug.
+	// 18 bytes encode to 24 base64 characters without any padding.
+	shareSlugBytes = 18
+	// The number of random bytes used to generate the Filename of an
+	// image. 12 bytes encode to 16 base64 characters.
+	imageFilenameBytes = 12
+
+	// MaxImageSize is the largest file CreateImage accepts. The file is
+	// held in memory twice while its metadata is stripped, on top of the
+	// decoded image, so this keeps a single upload from taking too much.
+	MaxImageSize = 25 << 20
+)
+
 type Gallery struct {
 	ID     int
 	UserID int
 	Title  string
+	// Description is written in Markdown.
+	Description string
+	// Tags are lower case words without spaces, see ParseTags.
+	Tags []string
+	// KeepCameraInfo stores the camera details (model, exposure, ...) of
+	// uploaded photos so they can be shown next to them. All other
+	// metadata is stripped from uploads either way.
+	KeepCameraInfo bool
+	// AllowDownload lets visitors download all images of the gallery as a
+	// single ZIP archive. The owner always can.
+	AllowDownload bool
+	// Visibility is one of VisibilityPrivate, VisibilityUnlisted or
+	// VisibilityPublic.
+	Visibility string
+	ShareSlug  string
+	// PasswordHash is the bcrypt hash of the password visitors need to
+	// enter to see the gallery. Empty when the gallery has no password.
+	PasswordHash string
+	// CoverImageID is the ID of the image that represents the gallery,
+	// 0 when the owner didn't pick one.
+	CoverImageID int
+}
+
+// IsVisibility reports whether v is a valid gallery visibility.
+func IsVisibility(v string) bool {
+	switch v {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return true
+	}
+	return false
 }
 
 type GalleryService struct {
 	DB *sql.DB
 
+	// Store is where the image files live. If not set, the GalleryService
+	// will default to a LocalImageStore using ImagesDir.
+	Store ImageStore
+
 	// ImagesDir is used to tell the GalleryService where to store and locate
-	// images. If not set, the GalleryService will default to using the
-	// "images" directory.
+	// images when no Store is set. If not set, the GalleryService will
+	// default to using the "images" directory.
 	ImagesDir string
+
+	// Quota limits how much users can upload. The zero value has no
+	// limits.
+	Quota Quota
 }
 
 func (service *GalleryService) Create(title string, userID int) (*Gallery, error) {
 	// TODO: Add validation for the id (no need for an MVP)
+	shareSlug, err := rand.String(shareSlugBytes)
+	if err != nil {
+		return nil, fmt.Errorf("create gallery: %w", err)
+	}
+
 	gallery := Gallery{
-		Title:  title,
-		UserID: userID,
+		Title:         title,
+		UserID:        userID,
+		AllowDownload: true,
+		Visibility:    VisibilityPrivate,
+		ShareSlug:     shareSlug,
 	}
 	row := service.DB.QueryRow(`
-		INSERT INTO galleries (title, user_id)
-		VALUES ($1, $2) RETURNING id;`, gallery.Title, gallery.UserID)
-	err := row.Scan(&gallery.ID)
+		INSERT INTO galleries (title, user_id, visibility, share_slug)
+		VALUES ($1, $2, $3, $4) RETURNING id;`, gallery.Title, gallery.UserID,
+		gallery.Visibility, gallery.ShareSlug)
+	err = row.Scan(&gallery.ID)
 
 	// I don't need to look for unique violations since two galleries can
 	// have the same title and a user can have multiple galleries.
@@ -54,21 +163,38 @@ func (service *GalleryService) Create(title string, userID int) (*Gallery, error
 
 func (service *GalleryService) ByID(id int) (*Gallery, error) {
 	// TODO: Add validation for the id (no need for an MVP)
-	gallery := Gallery{
-		ID: id,
+	var gallery Gallery
+	row := service.DB.QueryRow(`
+		SELECT `+galleryColumns+`
+		FROM galleries
+		WHERE id = $1;`, id)
+	err := scanGallery(row, &gallery)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query gallery by id: %w", err)
 	}
 
+	return &gallery, nil
+}
+
+// BySlug looks up a gallery by its share slug. It is up to the caller to
+// check that the gallery is actually shared.
+func (service *GalleryService) BySlug(slug string) (*Gallery, error) {
+	var gallery Gallery
 	row := service.DB.QueryRow(`
-		SELECT title, user_id
+		SELECT `+galleryColumns+`
 		FROM galleries
-		WHERE id = $1;`, gallery.ID)
-	err := row.Scan(&gallery.Title, &gallery.UserID)
+		WHERE share_slug = $1;`, slug)
+	err := scanGallery(row, &gallery)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNotFound
 		}
-		return nil, fmt.Errorf("query gallery by id: %w", err)
+		return nil, fmt.Errorf("query gallery by slug: %w", err)
 	}
 
 	return &gallery, nil
@@ -76,7 +202,7 @@ func (service *GalleryService) ByID(id int) (*Gallery, error) {
 
 func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	rows, err := service.DB.Query(`
-		SELECT id, title
+		SELECT `+galleryColumns+`
 		FROM galleries
 		WHERE user_id = $1;`, userID)
 	// service.DB.Query returns an error directly
@@ -86,10 +212,8 @@ func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 
 	var galleries []Gallery
 	for rows.Next() {
-		gallery := Gallery{
-			UserID: userID,
-		}
-		err = rows.Scan(&gallery.ID, &gallery.Title)
+		var gallery Gallery
+		err = scanGallery(rows, &gallery)
 		if err != nil {
 			return nil, fmt.Errorf("query galleries by user: %w", err)
 		}
@@ -104,10 +228,29 @@ func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 }
 
 func (service *GalleryService) Update(gallery *Gallery) error {
+	if !IsVisibility(gallery.Visibility) {
+		return fmt.Errorf("update gallery: invalid visibility %q",
+			gallery.Visibility)
+	}
+
+	// Galleries created before visibility existed don't have a share slug
+	// yet, so create one the first time they are shared as unlisted.
+	if gallery.Visibility == VisibilityUnlisted && gallery.ShareSlug == "" {
+		shareSlug, err := rand.String(shareSlugBytes)
+		if err != nil {
+			return fmt.Errorf("update gallery: %w", err)
+		}
+		gallery.ShareSlug = shareSlug
+	}
+
 	_, err := service.DB.Exec(`
 		UPDATE galleries 
-		SET title = $2
-		WHERE id = $1;`, gallery.ID, gallery.Title)
+		SET title = $2, keep_camera_info = $3, visibility = $4,
+			share_slug = NULLIF($5, ''), allow_download = $6, description = $7,
+			tags = $8
+		WHERE id = $1;`, gallery.ID, gallery.Title, gallery.KeepCameraInfo,
+		gallery.Visibility, gallery.ShareSlug, gallery.AllowDownload,
+		gallery.Description, strings.Join(gallery.Tags, " "))
 	if err != nil {
 		return fmt.Errorf("update gallery: %w", err)
 	}
@@ -115,94 +258,289 @@ func (service *GalleryService) Update(gallery *Gallery) error {
 	return nil
 }
 
-func (service *GalleryService) Delete(id int) error {
+// SetPassword protects a gallery with a password, replacing any existing
+// one. An empty password removes the protection.
+func (service *GalleryService) SetPassword(gallery *Gallery, password string) error {
+	passwordHash := ""
+	if password != "" {
+		hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password),
+			bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("set gallery password: %w", err)
+		}
+		passwordHash = string(hashedBytes)
+	}
+
 	_, err := service.DB.Exec(`
+		UPDATE galleries
+		SET password_hash = $2
+		WHERE id = $1;`, gallery.ID, passwordHash)
+	if err != nil {
+		return fmt.Errorf("set gallery password: %w", err)
+	}
+
+	gallery.PasswordHash = passwordHash
+	return nil
+}
+
+// CheckPassword returns ErrWrongPassword if password doesn't unlock the
+// gallery. Galleries without a password accept anything.
+func (service *GalleryService) CheckPassword(gallery *Gallery, password string) error {
+	if gallery.PasswordHash == "" {
+		return nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(gallery.PasswordHash),
+		[]byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrWrongPassword
+		}
+		return fmt.Errorf("check gallery password: %w", err)
+	}
+	return nil
+}
+
+func (service *GalleryService) Delete(id int) error {
+	// Look up the images first, the rows are gone once the gallery is
+	// deleted but their files (and resized variants) still need cleaning up.
+	images, err := service.Images(id)
+	if err != nil {
+		return fmt.Errorf("delete gallery: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
 		DELETE FROM galleries
 		WHERE id = $1;`, id)
 	if err != nil {
 		return fmt.Errorf("delete gallery: %w", err)
 	}
 
+	for _, image := range images {
+		err = service.deleteFiles(image)
+		if err != nil {
+			return fmt.Errorf("delete gallery: %w", err)
+		}
+	}
+
 	return nil
 }
 
 // Query for a set of images
 func (service *GalleryService) Images(galleryID int) ([]Image, error) {
-	// An example of what I need to achieve -> "images/gallery-2/*"
-	globPattern := filepath.Join(service.galleryDir(galleryID), "*")
-
-	// From std: Glob returns the names of all files matching
-	// pattern or nil if there is no matching file.
-	allFiles, err := filepath.Glob(globPattern)
+	rows, err := service.DB.Query(`
+		SELECT `+imageColumns+`
+		FROM images
+		WHERE gallery_id = $1
+		ORDER BY position, id;`, galleryID)
 	if err != nil {
 		return nil, fmt.Errorf("retrieving gallery images: %w", err)
 	}
+	defer rows.Close()
 
 	var images []Image
-	for _, file := range allFiles {
-		if hasExtension(file, service.extensions()) {
-			images = append(images, Image{
-				GalleryID: galleryID,
-				Path:      file,
-				Filename:  filepath.Base(file),
-			})
+	for rows.Next() {
+		var image Image
+		err = service.scanImage(rows, &image)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving gallery images: %w", err)
 		}
+		images = append(images, image)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("retrieving gallery images: %w", err)
 	}
+
 	return images, nil
 }
 
 // Query for a single image
 func (service *GalleryService) Image(galleryID int, filename string) (Image,
 	error) {
-	imagePath := filepath.Join(service.galleryDir(galleryID), filename)
-	// Check if the file exists.
-	_, err := os.Stat(imagePath)
+	var image Image
+	row := service.DB.QueryRow(`
+		SELECT `+imageColumns+`
+		FROM images
+		WHERE gallery_id = $1 AND filename = $2;`, galleryID, filename)
+	err := service.scanImage(row, &image)
 	if err != nil {
-		// fs.ErrNotExist represents the error when a file or directory does not exist
-		if errors.Is(err, fs.ErrNotExist) {
+		if errors.Is(err, sql.ErrNoRows) {
 			return Image{}, ErrNotFound
 		}
 		return Image{}, fmt.Errorf("querying for image: %w", err)
 	}
-	return Image{
-		Filename:  filename,
-		GalleryID: galleryID,
-		Path:      imagePath,
-	}, nil
+
+	return image, nil
+}
+
+// OpenImage returns the contents of an image so they can be served.
+// size is one of the ImageSizes names, or "" for the original. When the
+// requested variant doesn't exist (the original is smaller than that size,
+// or it was uploaded before variants were generated) the original is
+// returned instead.
+// Callers need to close the returned file.
+func (service *GalleryService) OpenImage(image Image, size string) (*ImageFile,
+	error) {
+	if size != "" {
+		file, err := service.store().Open(service.variantPath(image, size))
+		if err == nil {
+			return file, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("opening image: %w", err)
+		}
+	}
+
+	file, err := service.store().Open(image.Path)
+	if err != nil {
+		return nil, fmt.Errorf("opening image: %w", err)
+	}
+	return file, nil
 }
 
+// CreateImage adds an image to the gallery. filename is the name it was
+// uploaded with, the image is stored under a newly generated one. If the
+// gallery already has the exact same file, nothing is stored and
+// ErrDuplicateImage is returned.
 func (service *GalleryService) CreateImage(galleryID int, filename string,
-	contents io.ReadSeeker) error {
+	contents io.ReadSeeker) (*Image, error) {
 	err := checkContentType(contents, service.imageContentTypes())
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
 
 	err = checkExtension(filename, service.extensions())
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
 
-	galleryDir := service.galleryDir(galleryID)
-	// MkdirAll is the equivalent of -p flag when you do mkdir -p dir1/dir2/dir3
-	// 0755 is the default permission
-	err = os.MkdirAll(galleryDir, 0755)
+	gallery, err := service.ByID(galleryID)
 	if err != nil {
-		return fmt.Errorf("creating gallery-%d images directory: %w", galleryID, err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
 
-	imagePath := filepath.Join(galleryDir, filename)
-	dst, err := os.Create(imagePath)
+	// Phone photos carry GPS coordinates and other details in their
+	// metadata, which would leak to anyone viewing the gallery. Strip it
+	// before anything gets stored, keeping only the camera details when
+	// the gallery asks for them.
+	// The file is read into memory for that, which MaxImageSize keeps
+	// bounded however large the upload was.
+	original, err := io.ReadAll(io.LimitReader(contents, MaxImageSize+1))
 	if err != nil {
-		return fmt.Errorf("creating image file: %w", err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	if len(original) > MaxImageSize {
+		return nil, fmt.Errorf("creating image %v: %w", filename, FileError{
+			Issue: fmt.Sprintf("the file is larger than %d MB",
+				MaxImageSize>>20),
+		})
 	}
-	defer dst.Close()
 
-	_, err = io.Copy(dst, contents)
+	// The hash is taken before the metadata is stripped, since that
+	// depends on the gallery settings at the time of the upload.
+	contentHash := sha256.Sum256(original)
+	hash := hex.EncodeToString(contentHash[:])
+	duplicate, err := service.hasContentHash(galleryID, hash)
 	if err != nil {
-		return fmt.Errorf("copying contents to image: %w", err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
-	return nil
+	if duplicate {
+		return nil, fmt.Errorf("creating image %v: %w", filename,
+			ErrDuplicateImage)
+	}
+
+	contentType, err := detectContentType(bytes.NewReader(original))
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	stripped, exif, err := stripMetadata(original, contentType)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	contents = bytes.NewReader(stripped)
+
+	err = service.CheckQuota(gallery, int64(len(stripped)))
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+
+	image, err := service.imageInfo(contents)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	if gallery.KeepCameraInfo {
+		image.Camera = exif.Camera
+	}
+	image.GalleryID = galleryID
+	image.OriginalFilename = filename
+	image.ContentHash = hash
+	image.Filename, err = service.newFilename(filename)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	image.Path = path.Join(service.galleryDir(galleryID), image.Filename)
+
+	// Count the bytes while they are being written so I don't have to
+	// ask the store for the size afterwards.
+	counter := &countingReader{r: contents}
+	err = service.store().Put(image.Path, counter)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	image.Bytes = counter.n
+
+	err = service.createVariants(image, contents)
+	if err != nil {
+		service.discardFiles(image)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+
+	err = service.insertImage(&image)
+	if err != nil {
+		// This includes another upload of the same file finishing in the
+		// meantime. Either way nothing points to the stored files.
+		service.discardFiles(image)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	return &image, nil
+}
+
+// discardFiles deletes whatever CreateImage already stored for an image it
+// then failed to create. The upload failed already, so an error here is
+// only logged.
+func (service *GalleryService) discardFiles(image Image) {
+	err := service.deleteFiles(image)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// hasContentHash reports whether the gallery already has an image with the
+// given ContentHash.
+func (service *GalleryService) hasContentHash(galleryID int,
+	hash string) (bool, error) {
+	var exists bool
+	row := service.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM images
+			WHERE gallery_id = $1 AND content_hash = $2);`, galleryID, hash)
+	err := row.Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("has content hash: %w", err)
+	}
+	return exists, nil
+}
+
+// newFilename generates the name an image uploaded as filename is stored
+// under. Only the extension is kept, lower cased, so the content type of
+// the image can still be told from its name.
+func (service *GalleryService) newFilename(filename string) (string, error) {
+	name, err := rand.String(imageFilenameBytes)
+	if err != nil {
+		return "", fmt.Errorf("new filename: %w", err)
+	}
+	return name + strings.ToLower(filepath.Ext(filename)), nil
 }
 
 func (service *GalleryService) DeleteImage(galleryID int, filename string) error {
@@ -211,24 +549,392 @@ func (service *GalleryService) DeleteImage(galleryID int, filename string) error
 		return fmt.Errorf("deleting image: %w", err)
 	}
 
-	err = os.Remove(image.Path)
+	// If the files are already gone there is nothing left to clean up in
+	// the store, but the row still needs to go.
+	err = service.deleteFiles(image)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+		DELETE FROM images
+		WHERE id = $1;`, image.ID)
 	if err != nil {
 		return fmt.Errorf("deleting image: %w", err)
 	}
 	return nil
 }
 
-// galleryDir returns the filesystem path to the directory where
-// images for the gallery with the given ID are stored.
-// It uses the GalleryService.ImagesDir field as the base directory;
-// if ImagesDir is empty, it defaults to the "images" directory.
-// The final path is constructed as "<ImagesDir>/gallery-<id>".
-func (service *GalleryService) galleryDir(id int) string {
-	imagesDir := service.ImagesDir
-	if imagesDir == "" {
-		imagesDir = "images"
+// UpdateImage saves the Caption and AltText of an image.
+func (service *GalleryService) UpdateImage(image *Image) error {
+	_, err := service.DB.Exec(`
+		UPDATE images
+		SET caption = $2, alt_text = $3
+		WHERE id = $1;`, image.ID, image.Caption, image.AltText)
+	if err != nil {
+		return fmt.Errorf("update image: %w", err)
+	}
+	return nil
+}
+
+// ReorderImages puts the images of a gallery in the order of filenames.
+// Images missing from filenames keep their position relative to each
+// other and go after the ones that are listed, and unknown filenames are
+// ignored, so an image uploaded while the owner was reordering doesn't
+// get in the way.
+func (service *GalleryService) ReorderImages(galleryID int,
+	filenames []string) error {
+	images, err := service.Images(galleryID)
+	if err != nil {
+		return fmt.Errorf("reorder images: %w", err)
+	}
+
+	positions := make(map[string]int, len(filenames))
+	for i, filename := range filenames {
+		if _, ok := positions[filename]; !ok {
+			positions[filename] = i + 1
+		}
+	}
+	// Images are already sorted by position, so the ones that aren't
+	// listed stay in order.
+	next := len(filenames) + 1
+	for i := range images {
+		position, ok := positions[images[i].Filename]
+		if !ok {
+			position = next
+			next++
+		}
+		images[i].Position = position
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("reorder images: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, image := range images {
+		_, err = tx.Exec(`
+			UPDATE images
+			SET position = $2
+			WHERE id = $1;`, image.ID, image.Position)
+		if err != nil {
+			return fmt.Errorf("reorder images: %w", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("reorder images: %w", err)
+	}
+	return nil
+}
+
+// SetCover makes the image with the given filename the cover of the
+// gallery. An empty filename removes the cover, in which case the first
+// image is used instead.
+func (service *GalleryService) SetCover(gallery *Gallery, filename string) error {
+	coverImageID := 0
+	if filename != "" {
+		image, err := service.Image(gallery.ID, filename)
+		if err != nil {
+			return fmt.Errorf("set cover: %w", err)
+		}
+		coverImageID = image.ID
+	}
+
+	_, err := service.DB.Exec(`
+		UPDATE galleries
+		SET cover_image_id = NULLIF($2, 0)
+		WHERE id = $1;`, gallery.ID, coverImageID)
+	if err != nil {
+		return fmt.Errorf("set cover: %w", err)
+	}
+
+	gallery.CoverImageID = coverImageID
+	return nil
+}
+
+// Covers returns the cover image of each of the user's galleries, by
+// gallery ID. Galleries without a cover use their first image, and empty
+// galleries are left out.
+func (service *GalleryService) Covers(userID int) (map[int]Image, error) {
+	rows, err := service.DB.Query(`
+		SELECT `+imageColumns+`
+		FROM images
+		WHERE id IN (
+			SELECT DISTINCT ON (galleries.id) images.id
+			FROM galleries
+				JOIN images ON images.gallery_id = galleries.id
+			WHERE galleries.user_id = $1
+			ORDER BY galleries.id,
+				images.id = galleries.cover_image_id DESC NULLS LAST,
+				images.position, images.id);`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query covers: %w", err)
+	}
+	defer rows.Close()
+
+	covers := make(map[int]Image)
+	for rows.Next() {
+		var image Image
+		err = service.scanImage(rows, &image)
+		if err != nil {
+			return nil, fmt.Errorf("query covers: %w", err)
+		}
+		covers[image.GalleryID] = image
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("query covers: %w", err)
+	}
+	return covers, nil
+}
+
+// ReconcileImages walks the image store directory of every gallery and
+// creates the missing rows in the images table for files that were
+// uploaded before image metadata was stored in the database.
+// It returns the number of rows that were created.
+func (service *GalleryService) ReconcileImages() (int, error) {
+	rows, err := service.DB.Query(`
+		SELECT id FROM galleries ORDER BY id;`)
+	if err != nil {
+		return 0, fmt.Errorf("reconcile images: %w", err)
+	}
+
+	var galleryIDs []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("reconcile images: %w", err)
+		}
+		galleryIDs = append(galleryIDs, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("reconcile images: %w", err)
+	}
+
+	created := 0
+	for _, galleryID := range galleryIDs {
+		n, err := service.reconcileGallery(galleryID)
+		created += n
+		if err != nil {
+			return created, fmt.Errorf("reconcile images: %w", err)
+		}
+	}
+	return created, nil
+}
+
+func (service *GalleryService) reconcileGallery(galleryID int) (int, error) {
+	keys, err := service.store().List(service.galleryDir(galleryID))
+	if err != nil {
+		return 0, fmt.Errorf("gallery %d: %w", galleryID, err)
 	}
-	return filepath.Join(imagesDir, fmt.Sprintf("gallery-%d", id))
+
+	created := 0
+	for _, key := range keys {
+		if !hasExtension(key, service.extensions()) {
+			continue
+		}
+
+		filename := path.Base(key)
+		_, err := service.Image(galleryID, filename)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return created, fmt.Errorf("gallery %d: %w", galleryID, err)
+		}
+
+		file, err := service.store().Open(key)
+		if err != nil {
+			return created, fmt.Errorf("gallery %d: %w", galleryID, err)
+		}
+		image, err := service.imageInfo(file)
+		file.Close()
+		if err != nil {
+			// Skip files that aren't valid images instead of giving up on
+			// the whole gallery.
+			fmt.Printf("skipping %v: %v\n", key, err)
+			continue
+		}
+		image.GalleryID = galleryID
+		image.Filename = filename
+		image.OriginalFilename = filename
+		image.Path = key
+		image.Bytes = file.Size
+		image.CreatedAt = file.ModTime
+
+		err = service.insertImage(&image)
+		if err != nil {
+			return created, fmt.Errorf("gallery %d: %w", galleryID, err)
+		}
+		created++
+	}
+	return created, nil
+}
+
+// galleryColumns lists the columns of the galleries table in the order
+// scanGallery expects them.
+const galleryColumns = `id, user_id, title, keep_camera_info, allow_download,
+	visibility, COALESCE(share_slug, ''), password_hash,
+	COALESCE(cover_image_id, 0), description, tags`
+
+// scanGallery reads a row selected with galleryColumns into gallery.
+func scanGallery(row interface{ Scan(...any) error }, gallery *Gallery) error {
+	var tags string
+	err := row.Scan(&gallery.ID, &gallery.UserID, &gallery.Title,
+		&gallery.KeepCameraInfo, &gallery.AllowDownload, &gallery.Visibility,
+		&gallery.ShareSlug, &gallery.PasswordHash, &gallery.CoverImageID,
+		&gallery.Description, &tags)
+	if err != nil {
+		return err
+	}
+	gallery.Tags = strings.Fields(tags)
+	return nil
+}
+
+// imageColumns lists the columns of the images table in the order
+// scanImage expects them.
+const imageColumns = `id, gallery_id, filename, original_filename,
+	COALESCE(content_hash, ''), content_type, bytes, width, height, user_id,
+	created_at, position, caption, alt_text, camera_make, camera_model, lens,
+	exposure_time, f_number, iso, focal_length`
+
+// scanImage reads a row selected with imageColumns into image.
+func (service *GalleryService) scanImage(row interface{ Scan(...any) error },
+	image *Image) error {
+	camera := &image.Camera
+	err := row.Scan(&image.ID, &image.GalleryID, &image.Filename,
+		&image.OriginalFilename, &image.ContentHash, &image.ContentType,
+		&image.Bytes, &image.Width, &image.Height,
+		&image.UserID, &image.CreatedAt, &image.Position, &image.Caption,
+		&image.AltText, &camera.Make,
+		&camera.Model, &camera.Lens, &camera.ExposureTime, &camera.FNumber,
+		&camera.ISO, &camera.FocalLength)
+	if err != nil {
+		return err
+	}
+	image.Path = path.Join(service.galleryDir(image.GalleryID), image.Filename)
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// insertImage stores the metadata of an image, appending it to the end of
+// the gallery. If a row for the same file in the store already exists it
+// is updated instead of duplicated. It returns ErrDuplicateImage if the
+// gallery already has an image with the same ContentHash.
+// The uploader is always the owner of the gallery, since only they are
+// allowed to upload images to it.
+func (service *GalleryService) insertImage(image *Image) error {
+	createdAt := image.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	camera := image.Camera
+	row := service.DB.QueryRow(`
+		INSERT INTO images (gallery_id, filename, original_filename,
+			content_hash, content_type, bytes, width, height, user_id,
+			created_at, position, camera_make, camera_model, lens,
+			exposure_time, f_number, iso, focal_length)
+		SELECT galleries.id, $2, $3, NULLIF($4, ''), $5, $6, $7, $8,
+			galleries.user_id, $9,
+			COALESCE((SELECT MAX(position) FROM images
+				WHERE gallery_id = galleries.id), 0) + 1,
+			$10, $11, $12, $13, $14, $15, $16
+		FROM galleries
+		WHERE galleries.id = $1
+		ON CONFLICT (gallery_id, filename) DO
+		UPDATE
+		SET content_type = $5, bytes = $6, width = $7, height = $8,
+			camera_make = $10, camera_model = $11, lens = $12,
+			exposure_time = $13, f_number = $14, iso = $15, focal_length = $16
+		RETURNING id, user_id, created_at, position;`,
+		image.GalleryID, image.Filename, image.OriginalFilename,
+		image.ContentHash, image.ContentType, image.Bytes, image.Width,
+		image.Height, createdAt,
+		camera.Make, camera.Model, camera.Lens, camera.ExposureTime,
+		camera.FNumber, camera.ISO, camera.FocalLength)
+	err := row.Scan(&image.ID, &image.UserID, &image.CreatedAt, &image.Position)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		// Conflicts on the filename are handled above, so this can only
+		// be the content hash.
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			return ErrDuplicateImage
+		}
+		return fmt.Errorf("insert image: %w", err)
+	}
+	return nil
+}
+
+// imageInfo detects the content type and dimensions of an image and
+// rewinds r so it can be read again from the start.
+func (service *GalleryService) imageInfo(r io.ReadSeeker) (Image, error) {
+	contentType, err := detectContentType(r)
+	if err != nil {
+		return Image{}, fmt.Errorf("image info: %w", err)
+	}
+
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return Image{}, FileError{
+			Issue: fmt.Sprintf("unable to decode image: %v", err),
+		}
+	}
+	err = checkPixels(config.Width, config.Height)
+	if err != nil {
+		return Image{}, err
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return Image{}, fmt.Errorf("image info: %w", err)
+	}
+
+	return Image{
+		ContentType: contentType,
+		Width:       config.Width,
+		Height:      config.Height,
+	}, nil
+}
+
+// store returns the ImageStore images are kept in. If no Store was
+// provided it falls back to a LocalImageStore rooted at ImagesDir.
+func (service *GalleryService) store() ImageStore {
+	if service.Store != nil {
+		return service.Store
+	}
+	return &LocalImageStore{Dir: service.ImagesDir}
+}
+
+// galleryDir returns the key prefix ("directory") under which images
+// for the gallery with the given ID are stored in the ImageStore.
+// The final prefix is constructed as "gallery-<id>".
+func (service *GalleryService) galleryDir(id int) string {
+	return fmt.Sprintf("gallery-%d", id)
+}
+
+// CheckFilename returns a FileError if filename doesn't have one of the
+// extensions images can be uploaded with. CreateImage checks this too, it
+// is exported so that uploads can be rejected before any bytes are sent.
+func (service *GalleryService) CheckFilename(filename string) error {
+	return checkExtension(filename, service.extensions())
 }
 
 func (service *GalleryService) extensions() []string {
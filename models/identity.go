@@ -0,0 +1,183 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+// Identity links an account at an external OpenID Connect provider to a
+// user. The provider's subject never changes, unlike the email address.
+type Identity struct {
+	ID        int
+	UserID    int
+	Provider  string
+	Subject   string
+	Email     string
+	CreatedAt time.Time
+}
+
+type IdentityService struct {
+	DB *sql.DB
+}
+
+// User returns the user linked to the given provider account, or
+// ErrNotFound if there is none.
+func (service *IdentityService) User(provider, subject string) (*User, error) {
+	var user User
+	row := service.DB.QueryRow(`
+		SELECT users.id, users.email, users.email_verified_at
+		FROM user_identities
+		JOIN users ON users.id = user_identities.user_id
+		WHERE user_identities.provider = $1 AND user_identities.subject = $2;`,
+		provider, subject)
+	err := row.Scan(&user.ID, &user.Email, &user.EmailVerifiedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("identity user: %w", err)
+	}
+	return &user, nil
+}
+
+// Link connects a provider account to an existing user. It returns
+// ErrIdentityTaken if the provider account is linked to someone else, or
+// the user already has an account at the provider linked.
+func (service *IdentityService) Link(userID int, provider string,
+	claims *OIDCClaims) (*Identity, error) {
+	identity := Identity{
+		UserID:   userID,
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+	err := service.insert(service.DB, &identity)
+	if err != nil {
+		return nil, fmt.Errorf("link: %w", err)
+	}
+	return &identity, nil
+}
+
+// SignUp creates a new user for a provider account that isn't linked yet.
+// The user has no password, they can set one with the forgot password
+// flow. It returns ErrEmailTaken if there already is a user with the
+// email, since linking to it automatically would let anyone who controls
+// that address at the provider take over the account.
+func (service *IdentityService) SignUp(provider string, claims *OIDCClaims) (*User,
+	error) {
+	if claims.Email == "" {
+		return nil, fmt.Errorf("sign up: provider didn't share an email address")
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("sign up: %w", err)
+	}
+	defer tx.Rollback()
+
+	user := User{
+		Email: claims.Email,
+	}
+	var verifiedAt *time.Time
+	if claims.EmailVerified {
+		now := time.Now()
+		verifiedAt = &now
+	}
+	row := tx.QueryRow(`
+		INSERT INTO users (email, password_hash, email_verified_at)
+		VALUES ($1, '', $2)
+		RETURNING id, email_verified_at;`, user.Email, verifiedAt)
+	err = row.Scan(&user.ID, &user.EmailVerifiedAt)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			return nil, ErrEmailTaken
+		}
+		return nil, fmt.Errorf("sign up: %w", err)
+	}
+
+	identity := Identity{
+		UserID:   user.ID,
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+	err = service.insert(tx, &identity)
+	if err != nil {
+		return nil, fmt.Errorf("sign up: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("sign up: %w", err)
+	}
+	return &user, nil
+}
+
+// ByUserID returns the provider accounts linked to a user.
+func (service *IdentityService) ByUserID(userID int) ([]Identity, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, provider, subject, email, created_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY id;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query identities by user: %w", err)
+	}
+	defer rows.Close()
+
+	var identities []Identity
+	for rows.Next() {
+		identity := Identity{
+			UserID: userID,
+		}
+		err = rows.Scan(&identity.ID, &identity.Provider, &identity.Subject,
+			&identity.Email, &identity.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query identities by user: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("query identities by user: %w", err)
+	}
+	return identities, nil
+}
+
+// Delete unlinks one of the user's provider accounts.
+func (service *IdentityService) Delete(userID, id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM user_identities
+		WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("delete identity: %w", err)
+	}
+	return nil
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (service *IdentityService) insert(db queryRower, identity *Identity) error {
+	row := db.QueryRow(`
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at;`, identity.UserID, identity.Provider,
+		identity.Subject, identity.Email)
+	err := row.Scan(&identity.ID, &identity.CreatedAt)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			return ErrIdentityTaken
+		}
+		return err
+	}
+	return nil
+}
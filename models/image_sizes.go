@@ -0,0 +1,185 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	ImageSizeThumb  = "thumb"
+	ImageSizeMedium = "medium"
+	ImageSizeLarge  = "large"
+)
+
+type ImageSize struct {
+	Name string
+	// MaxDimension is the length in pixels of the longest side of the
+	// resized image.
+	MaxDimension int
+}
+
+// ImageSizes are the resized variants generated for every uploaded image,
+// ordered from the smallest to the largest.
+var ImageSizes = []ImageSize{
+	{Name: ImageSizeThumb, MaxDimension: 320},
+	{Name: ImageSizeMedium, MaxDimension: 960},
+	{Name: ImageSizeLarge, MaxDimension: 1920},
+}
+
+// ImageVariant is a resized version of an Image.
+type ImageVariant struct {
+	Size   string
+	Width  int
+	Height int
+}
+
+// IsImageSize reports whether name is one of the ImageSizes.
+func IsImageSize(name string) bool {
+	for _, size := range ImageSizes {
+		if size.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Variants returns the resized versions that exist for the image.
+// Images are never upscaled, so a size is only generated when the
+// original is larger than it.
+func (image Image) Variants() []ImageVariant {
+	longest := max(image.Width, image.Height)
+
+	var variants []ImageVariant
+	for _, size := range ImageSizes {
+		if longest <= size.MaxDimension {
+			continue
+		}
+		variants = append(variants, ImageVariant{
+			Size:   size.Name,
+			Width:  max(1, image.Width*size.MaxDimension/longest),
+			Height: max(1, image.Height*size.MaxDimension/longest),
+		})
+	}
+	return variants
+}
+
+// createVariants generates and stores every variant of image from the
+// original contents.
+func (service *GalleryService) createVariants(image Image,
+	contents io.ReadSeeker) error {
+	variants := image.Variants()
+	if len(variants) == 0 {
+		return nil
+	}
+
+	// imageInfo already checked this, but decoding is the step that
+	// allocates memory for every pixel so I check again right before it.
+	err := checkPixels(image.Width, image.Height)
+	if err != nil {
+		return fmt.Errorf("create variants: %w", err)
+	}
+
+	_, err = contents.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("create variants: %w", err)
+	}
+	src, format, err := decode(contents)
+	if err != nil {
+		return fmt.Errorf("create variants: %w", err)
+	}
+
+	for _, variant := range variants {
+		dst := resize(src, variant.Width, variant.Height)
+
+		var buf bytes.Buffer
+		err = encode(&buf, dst, format)
+		if err != nil {
+			return fmt.Errorf("create variants: %s: %w", variant.Size, err)
+		}
+
+		err = service.store().Put(service.variantPath(image, variant.Size), &buf)
+		if err != nil {
+			return fmt.Errorf("create variants: %s: %w", variant.Size, err)
+		}
+	}
+	return nil
+}
+
+// deleteFiles removes an image and all of its variants from the store.
+// Files that are already missing are ignored.
+func (service *GalleryService) deleteFiles(image Image) error {
+	paths := []string{image.Path}
+	for _, size := range ImageSizes {
+		paths = append(paths, service.variantPath(image, size.Name))
+	}
+
+	for _, p := range paths {
+		err := service.store().Delete(p)
+		if err != nil {
+			return fmt.Errorf("delete files: %w", err)
+		}
+	}
+	return nil
+}
+
+// variantPath returns the key of a resized image in the ImageStore.
+// Variants are kept in a sub directory per size, e.g.
+// "gallery-2/thumb/photo.jpg", so they never show up when listing the
+// originals of a gallery.
+func (service *GalleryService) variantPath(image Image, size string) string {
+	return path.Join(service.galleryDir(image.GalleryID), size, image.Filename)
+}
+
+// maxImagePixels is the largest image, in pixels, I'm willing to decode.
+// A small, highly compressed file can claim huge dimensions, and decoding
+// it would allocate several bytes of memory for every one of them.
+const maxImagePixels = 50_000_000
+
+// checkPixels returns a FileError when an image with the given dimensions
+// is too large to decode. Call it with the result of image.DecodeConfig
+// before decoding the whole image.
+func checkPixels(width, height int) error {
+	if int64(width)*int64(height) > maxImagePixels {
+		return FileError{
+			Issue: fmt.Sprintf("image is too large (%dx%d), the limit is "+
+				"%d megapixels", width, height, maxImagePixels/1_000_000),
+		}
+	}
+	return nil
+}
+
+// decode is a small wrapper so methods with an "image" variable in scope
+// can still reach the image package.
+func decode(r io.Reader) (image.Image, string, error) {
+	return image.Decode(r)
+}
+
+func resize(src image.Image, width, height int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+	return dst
+}
+
+// encode writes img in the given format, as returned by image.Decode.
+// Animated GIFs lose their animation, only the first frame is kept,
+// which is good enough for previews.
+func encode(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("encode: unsupported format %q", format)
+	}
+}
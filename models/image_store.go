@@ -0,0 +1,148 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// ImageStore is where the GalleryService keeps the actual image bytes.
+// Keys are slash separated paths like "gallery-2/photo.jpg", regardless
+// of the backend being used, so the GalleryService never needs to know
+// whether it is talking to the local disk or to an object store.
+type ImageStore interface {
+	// Put stores contents under key, replacing anything already stored there.
+	Put(key string, contents io.Reader) error
+	// Open returns the object stored under key, or ErrNotFound if there
+	// isn't one. Callers are responsible for closing the returned file.
+	Open(key string) (*ImageFile, error)
+	// List returns the keys of all objects directly inside dir.
+	List(dir string) ([]string, error)
+	// Delete removes the object stored under key. Deleting a key that
+	// doesn't exist is not an error, so images that are half gone can
+	// still be cleaned up.
+	Delete(key string) error
+}
+
+type ImageStoreConfig struct {
+	// Backend selects the ImageStore implementation, either "local" or "s3".
+	Backend string
+	// Dir is the base directory used by the "local" backend.
+	Dir string
+	S3  S3Config
+}
+
+// NewImageStore builds the ImageStore described by config. An empty Backend
+// is treated as "local".
+func NewImageStore(config ImageStoreConfig) (ImageStore, error) {
+	switch config.Backend {
+	case "", "local":
+		return &LocalImageStore{Dir: config.Dir}, nil
+	case "s3":
+		return NewS3ImageStore(config.S3), nil
+	default:
+		return nil, fmt.Errorf("new image store: unknown backend %q", config.Backend)
+	}
+}
+
+// ImageFile is an object read back from an ImageStore. It is seekable so
+// that it can be handed straight to http.ServeContent, which takes care
+// of range requests and conditional headers for us.
+type ImageFile struct {
+	io.ReadSeekCloser
+	Size    int64
+	ModTime time.Time
+}
+
+// LocalImageStore keeps images on the local filesystem under Dir. This is
+// what the GalleryService uses when no other ImageStore is provided.
+type LocalImageStore struct {
+	// Dir is the base directory for all images. Defaults to "images".
+	Dir string
+}
+
+func (store *LocalImageStore) Put(key string, contents io.Reader) error {
+	imagePath := store.path(key)
+	// MkdirAll is the equivalent of -p flag when you do mkdir -p dir1/dir2/dir3
+	// 0755 is the default permission
+	err := os.MkdirAll(filepath.Dir(imagePath), 0755)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+
+	dst, err := os.Create(imagePath)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, contents)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	return nil
+}
+
+func (store *LocalImageStore) Open(key string) (*ImageFile, error) {
+	f, err := os.Open(store.path(key))
+	if err != nil {
+		// fs.ErrNotExist represents the error when a file or directory does not exist
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("open %v: %w", key, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("open %v: %w", key, err)
+	}
+
+	return &ImageFile{
+		ReadSeekCloser: f,
+		Size:           info.Size(),
+		ModTime:        info.ModTime(),
+	}, nil
+}
+
+func (store *LocalImageStore) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(store.path(dir))
+	if err != nil {
+		// A gallery that never had an image uploaded has no directory yet.
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list %v: %w", dir, err)
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		keys = append(keys, path.Join(dir, entry.Name()))
+	}
+	return keys, nil
+}
+
+func (store *LocalImageStore) Delete(key string) error {
+	err := os.Remove(store.path(key))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	return nil
+}
+
+func (store *LocalImageStore) path(key string) string {
+	dir := store.Dir
+	if dir == "" {
+		dir = "images"
+	}
+	return filepath.Join(dir, filepath.FromSlash(key))
+}
@@ -0,0 +1,169 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/etaseq/lenslocked/rand"
+)
+
+const (
+	// Sign in links are as good as a password, so they don't live long.
+	DefaultMagicLinkDuration = 15 * time.Minute
+)
+
+type MagicLink struct {
+	ID     int
+	UserID int
+	// Token is only set when a MagicLink is being created.
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+// MagicLinkService creates the single use links that let users sign in
+// from their inbox instead of typing a password. It works just like the
+// PasswordResetService.
+type MagicLinkService struct {
+	DB *sql.DB
+	// Bytes per token is used to determine how many bytes to use when generating
+	// each sign in token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be used.
+	BytesPerToken int
+	// Duration is the amount of time that a MagicLink is valid for.
+	// Defaults to DefaultMagicLinkDuration.
+	Duration time.Duration
+}
+
+// Create a sign in link for the user with the given email. It returns
+// ErrNotFound if there is no such user. Only the latest link of a user
+// works.
+func (service *MagicLinkService) Create(email string) (*MagicLink, error) {
+	email = strings.ToLower(email)
+	var userID int
+
+	row := service.DB.QueryRow(`
+		SELECT id FROM users WHERE email = $1;`, email)
+	err := row.Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultMagicLinkDuration
+	}
+
+	link := MagicLink{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row = service.DB.QueryRow(`
+		INSERT INTO magic_links (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3) ON CONFLICT (user_id) DO
+		UPDATE
+		SET token_hash = $2, expires_at = $3
+		RETURNING id;`, link.UserID, link.TokenHash, link.ExpiresAt)
+	err = row.Scan(&link.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	return &link, nil
+}
+
+// Consume returns the user a sign in link belongs to and deletes the link
+// so it can only be used once. Following the link proves the user owns
+// the email address, so it is marked as verified too.
+func (service *MagicLinkService) Consume(token string) (*User, error) {
+	tokenHash := service.hash(token)
+	var user User
+	var link MagicLink
+
+	row := service.DB.QueryRow(`
+		SELECT magic_links.id,
+			magic_links.expires_at,
+			users.id,
+			users.email
+		FROM magic_links
+		JOIN users ON users.id = magic_links.user_id
+		WHERE magic_links.token_hash = $1;`, tokenHash)
+	err := row.Scan(&link.ID, &link.ExpiresAt, &user.ID, &user.Email)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+
+	if time.Now().After(link.ExpiresAt) {
+		return nil, fmt.Errorf("token expired: %v", token)
+	}
+
+	// Deleting before signing in makes sure two requests with the same
+	// link can't both succeed.
+	result, err := service.DB.Exec(`
+		DELETE FROM magic_links
+		WHERE id = $1;`, link.ID)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("consume: %w", ErrNotFound)
+	}
+
+	row = service.DB.QueryRow(`
+		UPDATE users
+		SET email_verified_at = COALESCE(email_verified_at, now())
+		WHERE id = $1
+		RETURNING email_verified_at;`, user.ID)
+	err = row.Scan(&user.EmailVerifiedAt)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+
+	return &user, nil
+}
+
+// DeleteExpired deletes the sign in links that can no longer be used.
+// It is run periodically by the Sweeper.
+func (service *MagicLinkService) DeleteExpired() (int64, error) {
+	result, err := service.DB.Exec(`
+		DELETE FROM magic_links
+		WHERE expires_at < $1;`, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("delete expired magic links: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired magic links: %w", err)
+	}
+	return n, nil
+}
+
+func (service *MagicLinkService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
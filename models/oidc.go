@@ -0,0 +1,457 @@
+package models
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/etaseq/lenslocked/rand"
+)
+
+const (
+	// oidcClockSkew is how far the clocks of the provider and this server
+	// may disagree when checking token timestamps.
+	oidcClockSkew = time.Minute
+)
+
+type OIDCConfig struct {
+	// ID identifies the provider in URLs and in the user_identities table,
+	// e.g. "google". It must never change once users linked accounts.
+	ID string
+	// Name is shown on the sign in buttons, e.g. "Google".
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback registered with the provider, e.g.
+	// "https://www.lenslocked.com/oauth/google/callback".
+	RedirectURL string
+	// Scopes defaults to "openid email profile".
+	Scopes []string
+}
+
+// OIDCAuthRequest holds the values of one sign in attempt that need to be
+// checked when the provider redirects back.
+type OIDCAuthRequest struct {
+	State string
+	Nonce string
+	// Verifier is the PKCE code verifier.
+	Verifier string
+}
+
+// OIDCClaims is what I use from a verified ID token.
+type OIDCClaims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// OIDCProvider signs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE. Like the S3ImageStore it only
+// implements the small part of the spec I need instead of pulling in a
+// library: discovery, the token request and verifying RS256 and ES256
+// signed ID tokens.
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	// The discovery document and keys are fetched on first use, so the app
+	// still starts when the provider is down.
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Just like the EmailService, an OIDCProvider needs a config so I
+// construct it with a function.
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &OIDCProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *OIDCProvider) ID() string {
+	return p.config.ID
+}
+
+func (p *OIDCProvider) Name() string {
+	return p.config.Name
+}
+
+// NewAuthRequest generates the random values for a new sign in attempt.
+func (p *OIDCProvider) NewAuthRequest() (*OIDCAuthRequest, error) {
+	var values [3]string
+	for i := range values {
+		// base64url output only uses characters PKCE allows in verifiers.
+		b, err := rand.Bytes(32)
+		if err != nil {
+			return nil, fmt.Errorf("new auth request: %w", err)
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return &OIDCAuthRequest{
+		State:    values[0],
+		Nonce:    values[1],
+		Verifier: values[2],
+	}, nil
+}
+
+// AuthCodeURL returns the URL of the provider's sign in page.
+func (p *OIDCProvider) AuthCodeURL(req *OIDCAuthRequest) (string, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", fmt.Errorf("auth code url: %w", err)
+	}
+
+	challenge := sha256.Sum256([]byte(req.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {req.State},
+		"nonce":                 {req.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return discovery.AuthorizationEndpoint + sep + query.Encode(), nil
+}
+
+// Exchange trades the authorization code for tokens and returns the
+// claims of the verified ID token.
+func (p *OIDCProvider) Exchange(req *OIDCAuthRequest, code string) (*OIDCClaims,
+	error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {req.Verifier},
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+	httpReq.SetBasicAuth(url.QueryEscape(p.config.ClientID),
+		url.QueryEscape(p.config.ClientSecret))
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("exchange: %s: %s", resp.Status,
+			strings.TrimSpace(string(msg)))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("exchange: %w: missing from response", ErrInvalidIDToken)
+	}
+
+	claims, err := p.verifyIDToken(tokens.IDToken, req.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+	return claims, nil
+}
+
+// verifyIDToken checks the signature and claims of an ID token, see
+// https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+func (p *OIDCProvider) verifyIDToken(token, nonce string) (*OIDCClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidIDToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidIDToken)
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims struct {
+		Issuer        string          `json:"iss"`
+		Subject       string          `json:"sub"`
+		Audience      json.RawMessage `json:"aud"`
+		AuthorizedBy  string          `json:"azp"`
+		ExpiresAt     int64           `json:"exp"`
+		IssuedAt      int64           `json:"iat"`
+		Nonce         string          `json:"nonce"`
+		Email         string          `json:"email"`
+		EmailVerified interface{}     `json:"email_verified"`
+	}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	// aud is either a single string or a list of them.
+	var audience []string
+	var single string
+	if json.Unmarshal(claims.Audience, &single) == nil {
+		audience = []string{single}
+	} else if json.Unmarshal(claims.Audience, &audience) != nil {
+		return nil, fmt.Errorf("%w: malformed audience", ErrInvalidIDToken)
+	}
+
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != discovery.Issuer:
+		return nil, fmt.Errorf("%w: wrong issuer %q", ErrInvalidIDToken, claims.Issuer)
+	case !contains(audience, p.config.ClientID):
+		return nil, fmt.Errorf("%w: wrong audience", ErrInvalidIDToken)
+	case len(audience) > 1 && claims.AuthorizedBy != p.config.ClientID:
+		return nil, fmt.Errorf("%w: wrong authorized party", ErrInvalidIDToken)
+	case now.After(time.Unix(claims.ExpiresAt, 0).Add(oidcClockSkew)):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)):
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidIDToken)
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: wrong nonce", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+
+	// Some providers send email_verified as a string.
+	verified := claims.EmailVerified == true || claims.EmailVerified == "true"
+	return &OIDCClaims{
+		Subject:       claims.Subject,
+		Email:         strings.ToLower(claims.Email),
+		EmailVerified: verified,
+	}, nil
+}
+
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	err := p.getJSON(p.config.Issuer+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, fmt.Errorf("discover: %w", err)
+	}
+	if discovery.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("discover: issuer %q doesn't match %q",
+			discovery.Issuer, p.config.Issuer)
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// key returns the signing key with the given ID. Providers rotate their
+// keys, so the key set is fetched again when the ID is unknown.
+func (p *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = p.getJSON(discovery.JWKSURI, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("fetch keys: %w", err)
+	}
+
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			// Skip keys for algorithms I don't support.
+			continue
+		}
+		p.keys[k.Kid] = key
+	}
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, kid)
+	}
+	return key, nil
+}
+
+func (p *OIDCProvider) getJSON(url string, v interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %v: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// jwk is a JSON Web Key (RFC 7517) holding an RSA or EC public key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch {
+	case k.Kty == "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("jwk: malformed exponent")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+	return nil, fmt.Errorf("jwk: unsupported key type %s", k.Kty)
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string,
+	signature []byte) error {
+	hash := sha256.Sum256([]byte(signed))
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature) != nil {
+			return fmt.Errorf("%w: invalid signature", ErrInvalidIDToken)
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		// JWTs use the raw r || s encoding instead of ASN.1.
+		if alg != "ES256" || len(signature) != 64 {
+			break
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return fmt.Errorf("%w: invalid signature", ErrInvalidIDToken)
+		}
+		return nil
+	}
+	// This also rejects "none" and keys used with the wrong algorithm.
+	return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidIDToken, alg)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: malformed", ErrInvalidIDToken)
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return fmt.Errorf("%w: malformed", ErrInvalidIDToken)
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package models
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "lenslocked"
+	testClientSecret = "client secret"
+	testAuthCode     = "authorization code"
+)
+
+// fakeOIDCProvider serves discovery, the key set and the token endpoint
+// of an OpenID Connect provider signing ID tokens with ES256.
+type fakeOIDCProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *ecdsa.PrivateKey
+	kid    string
+	// idToken is returned by the token endpoint.
+	idToken string
+	// verifier is the PKCE code verifier the token endpoint expects.
+	verifier string
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeOIDCProvider{
+		t:   t,
+		key: key,
+		kid: "key-1",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter,
+		r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 fake.server.URL,
+			"authorization_endpoint": fake.server.URL + "/authorize",
+			"token_endpoint":         fake.server.URL + "/token",
+			"jwks_uri":               fake.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "EC",
+				"kid": fake.kid,
+				"crv": "P-256",
+				"x":   b64(fake.key.X.FillBytes(make([]byte, 32))),
+				"y":   b64(fake.key.Y.FillBytes(make([]byte, 32))),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", fake.token)
+	fake.server = httptest.NewServer(mux)
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+func (fake *fakeOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if id != testClientID || secret != testClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" ||
+		r.PostFormValue("code") != testAuthCode ||
+		r.PostFormValue("code_verifier") != fake.verifier {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access token",
+		"token_type":   "Bearer",
+		"id_token":     fake.idToken,
+	})
+}
+
+// claims returns valid claims for an ID token answering req.
+func (fake *fakeOIDCProvider) claims(req *OIDCAuthRequest) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            fake.server.URL,
+		"sub":            "user-1",
+		"aud":            testClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          req.Nonce,
+		"email":          "Jon@Example.com",
+		"email_verified": true,
+	}
+}
+
+// sign returns an ES256 signed JWT with the given claims.
+func (fake *fakeOIDCProvider) sign(key *ecdsa.PrivateKey, kid string,
+	claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{
+		"alg": "ES256",
+		"typ": "JWT",
+		"kid": kid,
+	})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+
+	hash := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		fake.t.Fatal(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + b64(signature)
+}
+
+func (fake *fakeOIDCProvider) provider(t *testing.T) (*OIDCProvider,
+	*OIDCAuthRequest) {
+	t.Helper()
+	provider := NewOIDCProvider(OIDCConfig{
+		ID:           "test",
+		Name:         "Test",
+		Issuer:       fake.server.URL + "/",
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  "http://localhost:3000/oauth/test/callback",
+	})
+	req, err := provider.NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.verifier = req.Verifier
+	return provider, req
+}
+
+func TestOIDCAuthCodeURL(t *testing.T) {
+	fake := newFakeOIDCProvider(t)
+	provider, req := fake.provider(t)
+
+	authURL, err := provider.AuthCodeURL(req)
+	if err != nil {
+		t.Fatalf("AuthCodeURL() err = %v", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, fake.server.URL+"/authorize?") {
+		t.Errorf("AuthCodeURL() = %q, want the authorization endpoint", authURL)
+	}
+	challenge := sha256.Sum256([]byte(req.Verifier))
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"state":                 req.State,
+		"nonce":                 req.Nonce,
+		"code_challenge":        base64.RawURLEncoding.EncodeToString(challenge[:]),
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if got := u.Query().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	fake := newFakeOIDCProvider(t)
+	provider, req := fake.provider(t)
+	fake.idToken = fake.sign(fake.key, fake.kid, fake.claims(req))
+
+	claims, err := provider.Exchange(req, testAuthCode)
+	if err != nil {
+		t.Fatalf("Exchange() err = %v", err)
+	}
+	want := OIDCClaims{
+		Subject:       "user-1",
+		Email:         "jon@example.com",
+		EmailVerified: true,
+	}
+	if *claims != want {
+		t.Errorf("Exchange() = %+v, want %+v", *claims, want)
+	}
+
+	// The token endpoint only accepts the verifier matching the challenge
+	// sent to the authorization endpoint.
+	fake.verifier = "another verifier"
+	_, err = provider.Exchange(req, testAuthCode)
+	if err == nil {
+		t.Errorf("Exchange() with the wrong verifier err = nil, want an error")
+	}
+}
+
+func TestOIDCExchangeInvalidIDToken(t *testing.T) {
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]func(fake *fakeOIDCProvider, claims map[string]interface{}) string{
+		"bad signature": func(fake *fakeOIDCProvider, claims map[string]interface{}) string {
+			return fake.sign(otherKey, fake.kid, claims)
+		},
+		"unknown kid": func(fake *fakeOIDCProvider, claims map[string]interface{}) string {
+			return fake.sign(fake.key, "key-2", claims)
+		},
+		"wrong audience": func(fake *fakeOIDCProvider, claims map[string]interface{}) string {
+			claims["aud"] = "another client"
+			return fake.sign(fake.key, fake.kid, claims)
+		},
+		"wrong authorized party": func(fake *fakeOIDCProvider, claims map[string]interface{}) string {
+			claims["aud"] = []string{testClientID, "another client"}
+			claims["azp"] = "another client"
+			return fake.sign(fake.key, fake.kid, claims)
+		},
+		"wrong issuer": func(fake *fakeOIDCProvider, claims map[string]interface{}) string {
+			claims["iss"] = "https://evil.test"
+			return fake.sign(fake.key, fake.kid, claims)
+		},
+		"expired": func(fake *fakeOIDCProvider, claims map[string]interface{}) string {
+			claims["exp"] = time.Now().Add(-oidcClockSkew - time.Minute).Unix()
+			return fake.sign(fake.key, fake.kid, claims)
+		},
+		"issued in the future": func(fake *fakeOIDCProvider, claims map[string]interface{}) string {
+			claims["iat"] = time.Now().Add(oidcClockSkew + time.Minute).Unix()
+			return fake.sign(fake.key, fake.kid, claims)
+		},
+		"wrong nonce": func(fake *fakeOIDCProvider, claims map[string]interface{}) string {
+			claims["nonce"] = "another nonce"
+			return fake.sign(fake.key, fake.kid, claims)
+		},
+		"missing subject": func(fake *fakeOIDCProvider, claims map[string]interface{}) string {
+			delete(claims, "sub")
+			return fake.sign(fake.key, fake.kid, claims)
+		},
+		"alg none": func(fake *fakeOIDCProvider, claims map[string]interface{}) string {
+			header, _ := json.Marshal(map[string]string{"alg": "none", "kid": fake.kid})
+			payload, _ := json.Marshal(claims)
+			return b64(header) + "." + b64(payload) + "."
+		},
+		"malformed": func(fake *fakeOIDCProvider, claims map[string]interface{}) string {
+			return "not a jwt"
+		},
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			fake := newFakeOIDCProvider(t)
+			provider, req := fake.provider(t)
+			fake.idToken = token(fake, fake.claims(req))
+
+			_, err := provider.Exchange(req, testAuthCode)
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("Exchange() err = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
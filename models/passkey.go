@@ -0,0 +1,650 @@
+package models
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/etaseq/lenslocked/rand"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+const (
+	// passkeyTimeout is how long the browser waits for the user, in
+	// milliseconds.
+	passkeyTimeout = 5 * 60 * 1000
+
+	passkeyChallengeBytes = 32
+
+	// COSE algorithm identifiers, see
+	// https://www.iana.org/assignments/cose/cose.xhtml#algorithms
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+
+	// Flags of the authenticator data.
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataAttested     = 0x40
+)
+
+// Passkey is a WebAuthn credential a user can sign in with instead of a
+// password.
+type Passkey struct {
+	ID           int
+	UserID       int
+	CredentialID []byte
+	// PublicKey is the COSE encoded public key of the credential.
+	PublicKey  []byte
+	SignCount  uint32
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// PasskeyService implements the relying party side of WebAuthn. It only
+// asks for "none" attestation, which is what passkeys use anyway: I want
+// to know a user has the private key, not which device it lives on. That
+// keeps the whole thing small enough to not need a WebAuthn library.
+//
+// Challenges are created with NewPasskeyChallenge and kept by the caller
+// (in a signed cookie) between the options and the verification step.
+// The service records the challenges it accepted so none of them can be
+// used twice.
+type PasskeyService struct {
+	DB *sql.DB
+	// RPID is the domain passkeys are bound to, e.g. "www.lenslocked.com".
+	RPID string
+	// RPName is shown by the browser when creating a passkey.
+	RPName string
+	// Origin is where the sign in pages are served from, e.g.
+	// "https://www.lenslocked.com". Browsers report it to stop phishing
+	// sites from relaying a ceremony.
+	Origin string
+}
+
+// PasskeyDescriptor identifies a credential in the options.
+type PasskeyDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// PasskeyCreationOptions are the publicKey options for
+// navigator.credentials.create(). Binary values are base64url encoded.
+type PasskeyCreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams []struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	} `json:"pubKeyCredParams"`
+	Timeout                int                 `json:"timeout"`
+	ExcludeCredentials     []PasskeyDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// PasskeyRequestOptions are the publicKey options for
+// navigator.credentials.get(). No credentials are listed so the browser
+// offers every passkey the user has for the site.
+type PasskeyRequestOptions struct {
+	Challenge        string `json:"challenge"`
+	RPID             string `json:"rpId"`
+	Timeout          int    `json:"timeout"`
+	UserVerification string `json:"userVerification"`
+}
+
+// PasskeyCredential is the PublicKeyCredential returned by the browser,
+// with every binary value base64url encoded. Registration fills in
+// AttestationObject, signing in fills in the rest.
+type PasskeyCredential struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// NewPasskeyChallenge returns a random challenge for a single ceremony.
+func NewPasskeyChallenge() (string, error) {
+	b, err := rand.Bytes(passkeyChallengeBytes)
+	if err != nil {
+		return "", fmt.Errorf("new passkey challenge: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CreationOptions returns the options to register a new passkey for user.
+func (service *PasskeyService) CreationOptions(user *User,
+	challenge string) (*PasskeyCreationOptions, error) {
+	passkeys, err := service.ByUserID(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("creation options: %w", err)
+	}
+
+	var options PasskeyCreationOptions
+	options.Challenge = challenge
+	options.RP.ID = service.RPID
+	options.RP.Name = service.RPName
+	options.User.ID = passkeyUserHandle(user.ID)
+	options.User.Name = user.Email
+	options.User.DisplayName = user.Email
+	for _, alg := range []int{coseAlgES256, coseAlgEdDSA, coseAlgRS256} {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, struct {
+			Type string `json:"type"`
+			Alg  int    `json:"alg"`
+		}{"public-key", alg})
+	}
+	options.Timeout = passkeyTimeout
+	// Don't let the same authenticator be registered twice.
+	options.ExcludeCredentials = []PasskeyDescriptor{}
+	for _, passkey := range passkeys {
+		options.ExcludeCredentials = append(options.ExcludeCredentials,
+			PasskeyDescriptor{
+				Type: "public-key",
+				ID:   base64.RawURLEncoding.EncodeToString(passkey.CredentialID),
+			})
+	}
+	options.AuthenticatorSelection.ResidentKey = "required"
+	options.AuthenticatorSelection.UserVerification = "required"
+	options.Attestation = "none"
+	return &options, nil
+}
+
+// RequestOptions returns the options to sign in with a passkey.
+func (service *PasskeyService) RequestOptions(challenge string) *PasskeyRequestOptions {
+	return &PasskeyRequestOptions{
+		Challenge:        challenge,
+		RPID:             service.RPID,
+		Timeout:          passkeyTimeout,
+		UserVerification: "required",
+	}
+}
+
+// Register verifies the response of navigator.credentials.create() and
+// stores the new passkey for the user.
+func (service *PasskeyService) Register(user *User, name, challenge string,
+	credential PasskeyCredential) (*Passkey, error) {
+	authData, err := service.verifyRegistration(challenge, credential)
+	if err != nil {
+		return nil, fmt.Errorf("register: %w", err)
+	}
+	err = service.useChallenge(challenge)
+	if err != nil {
+		return nil, fmt.Errorf("register: %w", err)
+	}
+
+	if name == "" {
+		name = "Passkey"
+	}
+	passkey := Passkey{
+		UserID:       user.ID,
+		CredentialID: authData.CredentialID,
+		PublicKey:    authData.PublicKey,
+		SignCount:    authData.SignCount,
+		Name:         name,
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key,
+			sign_count, name)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at;`, passkey.UserID, passkey.CredentialID,
+		passkey.PublicKey, int64(passkey.SignCount), passkey.Name)
+	err = row.Scan(&passkey.ID, &passkey.CreatedAt)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			return nil, fmt.Errorf("register: %w",
+				passkeyError("credential is already registered"))
+		}
+		return nil, fmt.Errorf("register: %w", err)
+	}
+	return &passkey, nil
+}
+
+// Authenticate verifies the response of navigator.credentials.get() and
+// returns the user the passkey belongs to.
+func (service *PasskeyService) Authenticate(challenge string,
+	credential PasskeyCredential) (*User, error) {
+	credentialID, err := decodePasskeyField(credential.RawID)
+	if err != nil {
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+
+	var user User
+	var passkey Passkey
+	var signCount int64
+	row := service.DB.QueryRow(`
+		SELECT webauthn_credentials.id,
+			webauthn_credentials.public_key,
+			webauthn_credentials.sign_count,
+			users.id,
+			users.email
+		FROM webauthn_credentials
+		JOIN users ON users.id = webauthn_credentials.user_id
+		WHERE webauthn_credentials.credential_id = $1;`, credentialID)
+	err = row.Scan(&passkey.ID, &passkey.PublicKey, &signCount, &user.ID,
+		&user.Email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("authenticate: %w", passkeyError("unknown credential"))
+		}
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+	passkey.SignCount = uint32(signCount)
+
+	if credential.Response.UserHandle != "" &&
+		credential.Response.UserHandle != passkeyUserHandle(user.ID) {
+		return nil, fmt.Errorf("authenticate: %w", passkeyError("wrong user handle"))
+	}
+
+	newSignCount, err := service.verifyAssertion(passkey, challenge, credential)
+	if err != nil {
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+	err = service.useChallenge(challenge)
+	if err != nil {
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+		UPDATE webauthn_credentials
+		SET sign_count = $2, last_used_at = now()
+		WHERE id = $1;`, passkey.ID, int64(newSignCount))
+	if err != nil {
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+	return &user, nil
+}
+
+// ByUserID returns the passkeys of a user, oldest first.
+func (service *PasskeyService) ByUserID(userID int) ([]Passkey, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, credential_id, public_key, sign_count, name, created_at,
+			last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY id;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query passkeys by user: %w", err)
+	}
+	defer rows.Close()
+
+	var passkeys []Passkey
+	for rows.Next() {
+		passkey := Passkey{
+			UserID: userID,
+		}
+		var signCount int64
+		err = rows.Scan(&passkey.ID, &passkey.CredentialID, &passkey.PublicKey,
+			&signCount, &passkey.Name, &passkey.CreatedAt, &passkey.LastUsedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query passkeys by user: %w", err)
+		}
+		passkey.SignCount = uint32(signCount)
+		passkeys = append(passkeys, passkey)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("query passkeys by user: %w", err)
+	}
+	return passkeys, nil
+}
+
+// Delete removes one of the user's passkeys.
+func (service *PasskeyService) Delete(userID, id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM webauthn_credentials
+		WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("delete passkey: %w", err)
+	}
+	return nil
+}
+
+// useChallenge marks a challenge as used, or returns ErrInvalidPasskey if
+// it was used before. The challenge travels in a signed cookie, and
+// deleting that cookie only stops the honest browser from using it again.
+// Anyone who captured the cookie and the response could replay both
+// until the challenge expires, and most passkeys don't keep a sign count
+// that would give them away.
+func (service *PasskeyService) useChallenge(challenge string) error {
+	challengeHash := sha256.Sum256([]byte(challenge))
+	expiresAt := time.Now().Add(passkeyTimeout * time.Millisecond)
+	result, err := service.DB.Exec(`
+		INSERT INTO used_passkey_challenges (challenge_hash, expires_at)
+		VALUES ($1, $2)
+		ON CONFLICT (challenge_hash) DO NOTHING;`,
+		base64.URLEncoding.EncodeToString(challengeHash[:]), expiresAt)
+	if err != nil {
+		return fmt.Errorf("use challenge: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("use challenge: %w", err)
+	}
+	if n == 0 {
+		return passkeyError("challenge already used")
+	}
+	return nil
+}
+
+// DeleteExpired forgets the used challenges that have expired anyway. It
+// is run periodically by the Sweeper.
+func (service *PasskeyService) DeleteExpired() (int64, error) {
+	result, err := service.DB.Exec(`
+		DELETE FROM used_passkey_challenges
+		WHERE expires_at < $1;`, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("delete expired passkey challenges: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired passkey challenges: %w", err)
+	}
+	return n, nil
+}
+
+// verifyRegistration checks the response of navigator.credentials.create()
+// and returns the authenticator data holding the new credential.
+func (service *PasskeyService) verifyRegistration(challenge string,
+	credential PasskeyCredential) (*authenticatorData, error) {
+	clientData, err := decodePasskeyField(credential.Response.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	err = service.verifyClientData(clientData, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	attestation, err := decodePasskeyField(credential.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	decoded, _, err := decodeCBOR(attestation)
+	if err != nil {
+		return nil, passkeyError("malformed attestation")
+	}
+	object, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, passkeyError("malformed attestation")
+	}
+	authDataBytes, ok := object["authData"].([]byte)
+	if !ok {
+		return nil, passkeyError("missing authenticator data")
+	}
+
+	authData, err := service.parseAuthData(authDataBytes)
+	if err != nil {
+		return nil, err
+	}
+	if authData.Flags&authDataAttested == 0 {
+		return nil, passkeyError("missing credential")
+	}
+	// Make sure the key can actually be used before storing it.
+	_, err = parseCOSEKey(authData.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return authData, nil
+}
+
+// verifyAssertion checks the response of navigator.credentials.get() for
+// a stored passkey and returns the new sign count of the passkey.
+func (service *PasskeyService) verifyAssertion(passkey Passkey, challenge string,
+	credential PasskeyCredential) (uint32, error) {
+	clientData, err := decodePasskeyField(credential.Response.ClientDataJSON)
+	if err != nil {
+		return 0, err
+	}
+	err = service.verifyClientData(clientData, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+
+	authDataBytes, err := decodePasskeyField(credential.Response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	authData, err := service.parseAuthData(authDataBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	signature, err := decodePasskeyField(credential.Response.Signature)
+	if err != nil {
+		return 0, err
+	}
+	key, err := parseCOSEKey(passkey.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	// The authenticator signs its data followed by the hash of the client
+	// data, which holds the challenge.
+	clientDataHash := sha256.Sum256(clientData)
+	signed := append(append([]byte(nil), authDataBytes...), clientDataHash[:]...)
+	if !key.verify(signed, signature) {
+		return 0, passkeyError("invalid signature")
+	}
+
+	// Authenticators that keep a counter increase it on every use. If it
+	// goes backwards the credential has probably been cloned. Many
+	// passkeys always report 0, which means they don't keep one.
+	if (authData.SignCount != 0 || passkey.SignCount != 0) &&
+		authData.SignCount <= passkey.SignCount {
+		return 0, passkeyError("sign count went backwards")
+	}
+	return authData.SignCount, nil
+}
+
+func (service *PasskeyService) verifyClientData(raw []byte, ceremony,
+	challenge string) error {
+	var clientData struct {
+		Type        string `json:"type"`
+		Challenge   string `json:"challenge"`
+		Origin      string `json:"origin"`
+		CrossOrigin bool   `json:"crossOrigin"`
+	}
+	err := json.Unmarshal(raw, &clientData)
+	if err != nil {
+		return passkeyError("malformed client data")
+	}
+
+	switch {
+	case clientData.Type != ceremony:
+		return passkeyError("wrong ceremony " + clientData.Type)
+	case challenge == "" || clientData.Challenge != challenge:
+		return passkeyError("wrong challenge")
+	case clientData.Origin != service.Origin:
+		return passkeyError("wrong origin " + clientData.Origin)
+	case clientData.CrossOrigin:
+		return passkeyError("cross origin request")
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	Flags     byte
+	SignCount uint32
+	// CredentialID and PublicKey are only set when registering.
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// parseAuthData parses and checks the authenticator data, see
+// https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data
+func (service *PasskeyService) parseAuthData(data []byte) (*authenticatorData, error) {
+	// 32 bytes RP ID hash, 1 byte flags and 4 bytes sign count.
+	if len(data) < 37 {
+		return nil, passkeyError("authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(service.RPID))
+	if !bytes.Equal(data[:32], rpIDHash[:]) {
+		return nil, passkeyError("wrong relying party")
+	}
+
+	authData := authenticatorData{
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	// Passkeys replace both factors, so the authenticator must have
+	// checked it is the user (PIN, fingerprint, ...), not just that
+	// someone touched it.
+	if authData.Flags&authDataUserPresent == 0 {
+		return nil, passkeyError("user not present")
+	}
+	if authData.Flags&authDataUserVerified == 0 {
+		return nil, passkeyError("user not verified")
+	}
+
+	if authData.Flags&authDataAttested != 0 {
+		// 16 bytes AAGUID, then the length prefixed credential ID and the
+		// CBOR encoded public key.
+		rest := data[37:]
+		if len(rest) < 18 {
+			return nil, passkeyError("attested credential data too short")
+		}
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength == 0 || len(rest) < idLength {
+			return nil, passkeyError("malformed credential id")
+		}
+		authData.CredentialID = append([]byte(nil), rest[:idLength]...)
+		rest = rest[idLength:]
+
+		// Extensions may follow the key, so decode it to find where it ends.
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, passkeyError("malformed public key")
+		}
+		authData.PublicKey = append([]byte(nil), rest[:len(rest)-len(after)]...)
+	}
+	return &authData, nil
+}
+
+type coseKey struct {
+	alg int64
+	pub crypto.PublicKey
+}
+
+// parseCOSEKey reads a COSE_Key (RFC 8152) for one of the algorithms
+// offered in the creation options.
+func parseCOSEKey(data []byte) (*coseKey, error) {
+	decoded, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, passkeyError("malformed public key")
+	}
+	m, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, passkeyError("malformed public key")
+	}
+	alg, _ := m[int64(3)].(int64)
+	kty, _ := m[int64(1)].(int64)
+
+	switch {
+	case alg == coseAlgES256 && kty == 2:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, passkeyError("malformed P-256 key")
+		}
+		// ecdh rejects points that aren't on the curve.
+		point := append(append([]byte{4}, x...), y...)
+		_, err = ecdh.P256().NewPublicKey(point)
+		if err != nil {
+			return nil, passkeyError("malformed P-256 key")
+		}
+		return &coseKey{alg: alg, pub: &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}}, nil
+	case alg == coseAlgEdDSA && kty == 1:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, passkeyError("malformed Ed25519 key")
+		}
+		return &coseKey{alg: alg, pub: ed25519.PublicKey(x)}, nil
+	case alg == coseAlgRS256 && kty == 3:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(e) == 0 || len(e) > 4 {
+			return nil, passkeyError("malformed RSA key")
+		}
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if pub.N.BitLen() < 2048 {
+			return nil, passkeyError("RSA key too short")
+		}
+		return &coseKey{alg: alg, pub: pub}, nil
+	}
+	return nil, passkeyError("unsupported algorithm " + strconv.FormatInt(alg, 10))
+}
+
+func (key *coseKey) verify(data, signature []byte) bool {
+	switch pub := key.pub.(type) {
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(pub, hash[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, data, signature)
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature) == nil
+	}
+	return false
+}
+
+// passkeyUserHandle is the opaque user ID stored in passkeys. It must not
+// contain personal information, so it is just the user's ID.
+func passkeyUserHandle(userID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(userID)))
+}
+
+func decodePasskeyField(value string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, passkeyError("malformed base64url value")
+	}
+	return b, nil
+}
+
+func passkeyError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidPasskey, reason)
+}
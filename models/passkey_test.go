@@ -0,0 +1,331 @@
+package models
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"testing"
+)
+
+const (
+	testRPID   = "lenslocked.test"
+	testOrigin = "https://lenslocked.test"
+)
+
+// testAuthenticator is a software ES256 authenticator producing the same
+// responses a browser would hand over after a ceremony.
+type testAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthenticator{
+		key:          key,
+		credentialID: []byte("test credential id"),
+	}
+}
+
+// ceremony holds everything that goes into a response, so tests can
+// change one thing at a time.
+type ceremony struct {
+	Type      string
+	Challenge string
+	Origin    string
+	RPID      string
+	Flags     byte
+	SignCount uint32
+	// Signer signs assertions, the authenticator's own key by default.
+	Signer *ecdsa.PrivateKey
+}
+
+func (a *testAuthenticator) ceremony(typ, challenge string) ceremony {
+	return ceremony{
+		Type:      typ,
+		Challenge: challenge,
+		Origin:    testOrigin,
+		RPID:      testRPID,
+		Flags:     authDataUserPresent | authDataUserVerified,
+		Signer:    a.key,
+	}
+}
+
+// coseKey returns the COSE_Key encoding of the authenticator's public key.
+func (a *testAuthenticator) coseKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	return encodeCBOR(map[interface{}]interface{}{
+		int64(1):  int64(2),
+		int64(3):  int64(coseAlgES256),
+		int64(-1): int64(1),
+		int64(-2): x,
+		int64(-3): y,
+	})
+}
+
+func (a *testAuthenticator) authData(c ceremony, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	data := append([]byte(nil), rpIDHash[:]...)
+	flags := c.Flags
+	if attested {
+		flags |= authDataAttested
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, c.SignCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func clientDataJSON(c ceremony) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":      c.Type,
+		"challenge": c.Challenge,
+		"origin":    c.Origin,
+	})
+	return data
+}
+
+func (a *testAuthenticator) register(c ceremony) PasskeyCredential {
+	attestation := encodeCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": a.authData(c, true),
+	})
+
+	var credential PasskeyCredential
+	credential.ID = b64(a.credentialID)
+	credential.RawID = b64(a.credentialID)
+	credential.Type = "public-key"
+	credential.Response.ClientDataJSON = b64(clientDataJSON(c))
+	credential.Response.AttestationObject = b64(attestation)
+	return credential
+}
+
+func (a *testAuthenticator) assert(t *testing.T, c ceremony) PasskeyCredential {
+	t.Helper()
+	authData := a.authData(c, false)
+	clientData := clientDataJSON(c)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := sha256.Sum256(append(append([]byte(nil), authData...),
+		clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, c.Signer, signed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var credential PasskeyCredential
+	credential.ID = b64(a.credentialID)
+	credential.RawID = b64(a.credentialID)
+	credential.Type = "public-key"
+	credential.Response.ClientDataJSON = b64(clientData)
+	credential.Response.AuthenticatorData = b64(authData)
+	credential.Response.Signature = b64(signature)
+	return credential
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func testPasskeyService() *PasskeyService {
+	return &PasskeyService{
+		RPID:   testRPID,
+		RPName: "LensLocked",
+		Origin: testOrigin,
+	}
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	service := testPasskeyService()
+	authenticator := newTestAuthenticator(t)
+	const challenge = "registration-challenge"
+
+	authData, err := service.verifyRegistration(challenge,
+		authenticator.register(authenticator.ceremony("webauthn.create", challenge)))
+	if err != nil {
+		t.Fatalf("verifyRegistration() err = %v", err)
+	}
+	if string(authData.CredentialID) != string(authenticator.credentialID) {
+		t.Errorf("CredentialID = %q, want %q", authData.CredentialID,
+			authenticator.credentialID)
+	}
+	if string(authData.PublicKey) != string(authenticator.coseKey()) {
+		t.Errorf("PublicKey = %x, want %x", authData.PublicKey,
+			authenticator.coseKey())
+	}
+
+	tests := map[string]func(c *ceremony){
+		"wrong rp id hash":  func(c *ceremony) { c.RPID = "evil.test" },
+		"wrong origin":      func(c *ceremony) { c.Origin = "https://evil.test" },
+		"wrong challenge":   func(c *ceremony) { c.Challenge = "another-challenge" },
+		"empty challenge":   func(c *ceremony) { c.Challenge = "" },
+		"wrong ceremony":    func(c *ceremony) { c.Type = "webauthn.get" },
+		"user not present":  func(c *ceremony) { c.Flags &^= authDataUserPresent },
+		"user not verified": func(c *ceremony) { c.Flags &^= authDataUserVerified },
+	}
+	for name, change := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := authenticator.ceremony("webauthn.create", challenge)
+			change(&c)
+			expected := challenge
+			if c.Challenge == "" {
+				expected = ""
+			}
+			_, err := service.verifyRegistration(expected, authenticator.register(c))
+			if !errors.Is(err, ErrInvalidPasskey) {
+				t.Errorf("verifyRegistration() err = %v, want ErrInvalidPasskey", err)
+			}
+		})
+	}
+}
+
+func TestPasskeyAssertion(t *testing.T) {
+	service := testPasskeyService()
+	authenticator := newTestAuthenticator(t)
+	const challenge = "assertion-challenge"
+	passkey := Passkey{
+		CredentialID: authenticator.credentialID,
+		PublicKey:    authenticator.coseKey(),
+		SignCount:    5,
+	}
+
+	c := authenticator.ceremony("webauthn.get", challenge)
+	c.SignCount = 6
+	signCount, err := service.verifyAssertion(passkey, challenge,
+		authenticator.assert(t, c))
+	if err != nil {
+		t.Fatalf("verifyAssertion() err = %v", err)
+	}
+	if signCount != 6 {
+		t.Errorf("sign count = %d, want 6", signCount)
+	}
+
+	// Authenticators without a counter always report 0.
+	zero := passkey
+	zero.SignCount = 0
+	c.SignCount = 0
+	_, err = service.verifyAssertion(zero, challenge, authenticator.assert(t, c))
+	if err != nil {
+		t.Errorf("verifyAssertion() without sign count err = %v", err)
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]func(c *ceremony){
+		"wrong rp id hash":    func(c *ceremony) { c.RPID = "evil.test" },
+		"wrong origin":        func(c *ceremony) { c.Origin = "https://evil.test" },
+		"wrong challenge":     func(c *ceremony) { c.Challenge = "another-challenge" },
+		"wrong ceremony":      func(c *ceremony) { c.Type = "webauthn.create" },
+		"user not present":    func(c *ceremony) { c.Flags &^= authDataUserPresent },
+		"user not verified":   func(c *ceremony) { c.Flags &^= authDataUserVerified },
+		"same sign count":     func(c *ceremony) { c.SignCount = 5 },
+		"lower sign count":    func(c *ceremony) { c.SignCount = 4 },
+		"sign count reset":    func(c *ceremony) { c.SignCount = 0 },
+		"signed by other key": func(c *ceremony) { c.Signer = otherKey },
+	}
+	for name, change := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := authenticator.ceremony("webauthn.get", challenge)
+			c.SignCount = 6
+			change(&c)
+			_, err := service.verifyAssertion(passkey, challenge,
+				authenticator.assert(t, c))
+			if !errors.Is(err, ErrInvalidPasskey) {
+				t.Errorf("verifyAssertion() err = %v, want ErrInvalidPasskey", err)
+			}
+		})
+	}
+
+	t.Run("tampered authenticator data", func(t *testing.T) {
+		c := authenticator.ceremony("webauthn.get", challenge)
+		c.SignCount = 6
+		credential := authenticator.assert(t, c)
+		c.SignCount = 7
+		credential.Response.AuthenticatorData = b64(authenticator.authData(c, false))
+		_, err := service.verifyAssertion(passkey, challenge, credential)
+		if !errors.Is(err, ErrInvalidPasskey) {
+			t.Errorf("verifyAssertion() err = %v, want ErrInvalidPasskey", err)
+		}
+	})
+}
+
+// encodeCBOR encodes the types decodeCBOR returns. Map keys are sorted
+// so the output is deterministic.
+func encodeCBOR(v interface{}) []byte {
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []interface{}:
+		out := cborHead(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+	case map[interface{}]interface{}:
+		keys := make([][]byte, 0, len(v))
+		encoded := make(map[string][]byte, len(v))
+		for key, value := range v {
+			k := encodeCBOR(key)
+			keys = append(keys, k)
+			encoded[string(k)] = encodeCBOR(value)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return string(keys[i]) < string(keys[j])
+		})
+		out := cborHead(5, uint64(len(v)))
+		for _, k := range keys {
+			out = append(out, k...)
+			out = append(out, encoded[string(k)]...)
+		}
+		return out
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case nil:
+		return []byte{0xf6}
+	}
+	panic("encodeCBOR: unsupported type")
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+}
@@ -125,6 +125,23 @@ func (service *PasswordResetService) Consume(token string) (*User, error) {
 	return &user, nil
 }
 
+// DeleteExpired deletes the password resets that can no longer be used.
+// It is run periodically by the Sweeper.
+func (service *PasswordResetService) DeleteExpired() (int64, error) {
+	result, err := service.DB.Exec(`
+		DELETE FROM password_resets
+		WHERE expires_at < $1;`, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("delete expired password resets: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired password resets: %w", err)
+	}
+	return n, nil
+}
+
 func (service *PasswordResetService) hash(token string) string {
 	tokenHash := sha256.Sum256([]byte(token))
 	// Notice that Sum256 returns an array so I need to use [:]
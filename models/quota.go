@@ -0,0 +1,125 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Quota limits how much users can store. Zero values mean there is no
+// limit.
+type Quota struct {
+	// UserBytes and UserImages limit all the images of a user.
+	UserBytes  int64
+	UserImages int
+	// GalleryBytes and GalleryImages limit the images of each gallery.
+	GalleryBytes  int64
+	GalleryImages int
+}
+
+// Usage is how much a user stores, along with the limits of their Quota.
+type Usage struct {
+	Bytes  int64
+	Images int
+	// MaxBytes and MaxImages are 0 when there is no limit.
+	MaxBytes  int64
+	MaxImages int
+}
+
+// QuotaError is returned when adding an image would go over a Quota. The
+// Issue is meant for the user, so QuotaErrors are public errors that pages
+// show as is.
+type QuotaError struct {
+	Issue string
+}
+
+func (qe QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded: %v", qe.Issue)
+}
+
+func (qe QuotaError) Public() string {
+	return qe.Issue
+}
+
+// Usage returns how much the user stores across all of their galleries.
+func (service *GalleryService) Usage(userID int) (*Usage, error) {
+	usage := Usage{
+		MaxBytes:  service.Quota.UserBytes,
+		MaxImages: service.Quota.UserImages,
+	}
+	row := service.DB.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(bytes), 0)
+		FROM images
+		WHERE user_id = $1;`, userID)
+	err := row.Scan(&usage.Images, &usage.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("usage: %w", err)
+	}
+	return &usage, nil
+}
+
+// CheckQuota returns a QuotaError if adding an image of size bytes to the
+// gallery would go over the Quota of its owner or of the gallery itself.
+// CreateImage checks this too, it is exported so that uploads can be
+// rejected before any bytes are sent.
+//
+// Two uploads finishing at the same time can both pass the check and go
+// over a limit by an image, which is fine for keeping storage in check.
+func (service *GalleryService) CheckQuota(gallery *Gallery, size int64) error {
+	quota := service.Quota
+	if quota == (Quota{}) {
+		return nil
+	}
+
+	var userImages, galleryImages int
+	var userBytes, galleryBytes int64
+	row := service.DB.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(bytes), 0),
+			COUNT(*) FILTER (WHERE gallery_id = $2),
+			COALESCE(SUM(bytes) FILTER (WHERE gallery_id = $2), 0)
+		FROM images
+		WHERE user_id = $1;`, gallery.UserID, gallery.ID)
+	err := row.Scan(&userImages, &userBytes, &galleryImages, &galleryBytes)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+
+	switch {
+	case quota.UserImages > 0 && userImages+1 > quota.UserImages:
+		return QuotaError{
+			Issue: fmt.Sprintf("You can't have more than %d images.",
+				quota.UserImages),
+		}
+	case quota.UserBytes > 0 && userBytes+size > quota.UserBytes:
+		return QuotaError{
+			Issue: fmt.Sprintf("You can't store more than %s of images.",
+				FormatBytes(quota.UserBytes)),
+		}
+	case quota.GalleryImages > 0 && galleryImages+1 > quota.GalleryImages:
+		return QuotaError{
+			Issue: fmt.Sprintf("A gallery can't have more than %d images.",
+				quota.GalleryImages),
+		}
+	case quota.GalleryBytes > 0 && galleryBytes+size > quota.GalleryBytes:
+		return QuotaError{
+			Issue: fmt.Sprintf("A gallery can't store more than %s of images.",
+				FormatBytes(quota.GalleryBytes)),
+		}
+	}
+	return nil
+}
+
+// FormatBytes returns n in the largest unit it is at least one of, e.g.
+// "1.5 GB" or "300 KB".
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	value := strings.TrimSuffix(fmt.Sprintf("%.1f", float64(n)/float64(div)), ".0")
+	return fmt.Sprintf("%s %cB", value, "KMGT"[exp])
+}
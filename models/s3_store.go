@@ -0,0 +1,357 @@
+package models
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type S3Config struct {
+	// Endpoint is the base URL of the object store, for example
+	// "https://s3.eu-central-1.amazonaws.com" or "http://localhost:9000"
+	// for a local MinIO server.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3ImageStore is an ImageStore backed by any S3 compatible object store
+// (AWS S3, MinIO, ...). Requests use path-style addressing
+// (<endpoint>/<bucket>/<key>) because that is what MinIO expects by default
+// and AWS still supports it.
+//
+// I only need a handful of operations so instead of pulling in a full SDK
+// requests are signed by hand using AWS Signature Version 4.
+type S3ImageStore struct {
+	config S3Config
+	client *http.Client
+}
+
+// Just like the EmailService, the S3ImageStore needs a config to be useful
+// so I construct it with a function.
+func NewS3ImageStore(config S3Config) *S3ImageStore {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+
+	return &S3ImageStore{
+		config: config,
+		client: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+func (store *S3ImageStore) Put(key string, contents io.Reader) error {
+	// The payload hash is part of the signature, so the whole object needs
+	// to be read before the request can be sent. Images are at most
+	// MaxImageSize and chunks of resumable uploads at most maxChunkSize,
+	// so buffering them is fine.
+	body, err := io.ReadAll(contents)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+
+	resp, err := store.do(http.MethodPut, key, nil, nil, body)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("put %v: %w", key, s3Error(resp))
+	}
+	return nil
+}
+
+func (store *S3ImageStore) Open(key string) (*ImageFile, error) {
+	resp, err := store.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("open %v: %w", key, err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	default:
+		return nil, fmt.Errorf("open %v: %w", key, s3Error(resp))
+	}
+
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		// Not having a modification time only disables conditional requests.
+		modTime = time.Time{}
+	}
+
+	return &ImageFile{
+		ReadSeekCloser: &s3Object{store: store, key: key, size: resp.ContentLength},
+		Size:           resp.ContentLength,
+		ModTime:        modTime,
+	}, nil
+}
+
+func (store *S3ImageStore) List(dir string) ([]string, error) {
+	var keys []string
+	var continuationToken string
+
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {strings.TrimSuffix(dir, "/") + "/"},
+			"delimiter": {"/"},
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		resp, err := store.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("list %v: %w", dir, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp)
+			resp.Body.Close()
+			return nil, fmt.Errorf("list %v: %w", dir, err)
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %v: %w", dir, err)
+		}
+
+		for _, obj := range result.Contents {
+			keys = append(keys, obj.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (store *S3ImageStore) Delete(key string) error {
+	// S3 happily "deletes" objects that don't exist, which is exactly
+	// what the ImageStore interface asks for. Some compatible servers
+	// answer with a 404 instead.
+	resp, err := store.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK, http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("delete %v: %w", key, s3Error(resp))
+}
+
+// do builds, signs and sends a request for key in the configured bucket.
+// An empty key addresses the bucket itself (used for listing).
+func (store *S3ImageStore) do(method, key string, query url.Values,
+	header http.Header, body []byte) (*http.Response, error) {
+	uri := "/" + s3Escape(store.config.Bucket, false)
+	if key != "" {
+		uri += "/" + s3Escape(key, true)
+	}
+
+	req, err := http.NewRequest(method, store.config.Endpoint+uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = s3CanonicalQuery(query)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body == nil {
+		// Let net/http know there is no body instead of sending an empty one.
+		req.Body = http.NoBody
+		req.ContentLength = 0
+	}
+
+	store.sign(req, uri, body, time.Now().UTC())
+	return store.client.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+// See https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func (store *S3ImageStore) sign(req *http.Request, uri string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	payloadHashHex := hex.EncodeToString(payloadHash[:])
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHashHex)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHashHex + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHashHex,
+	}, "\n")
+
+	scope := date + "/" + store.config.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+store.config.SecretKey), date)
+	key = hmacSHA256(key, store.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		store.config.AccessKey, scope, signedHeaders, signature))
+}
+
+// s3Object reads an object lazily using range requests so that it can be
+// seeked without downloading the whole thing first.
+type s3Object struct {
+	store  *S3ImageStore
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (obj *s3Object) Read(p []byte) (int, error) {
+	if obj.offset >= obj.size {
+		return 0, io.EOF
+	}
+
+	if obj.body == nil {
+		header := http.Header{}
+		header.Set("Range", "bytes="+strconv.FormatInt(obj.offset, 10)+"-")
+		resp, err := obj.store.do(http.MethodGet, obj.key, nil, header, nil)
+		if err != nil {
+			return 0, fmt.Errorf("read %v: %w", obj.key, err)
+		}
+		switch {
+		case resp.StatusCode == http.StatusPartialContent:
+		// A server that doesn't support ranges sends the whole object,
+		// which is only what I asked for when reading from the start.
+		case resp.StatusCode == http.StatusOK && obj.offset == 0:
+		case resp.StatusCode == http.StatusOK:
+			resp.Body.Close()
+			return 0, fmt.Errorf("read %v: range request ignored", obj.key)
+		default:
+			err = s3Error(resp)
+			resp.Body.Close()
+			return 0, fmt.Errorf("read %v: %w", obj.key, err)
+		}
+		obj.body = resp.Body
+	}
+
+	n, err := obj.body.Read(p)
+	obj.offset += int64(n)
+	return n, err
+}
+
+func (obj *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = obj.offset + offset
+	case io.SeekEnd:
+		newOffset = obj.size + offset
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+	if newOffset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+
+	if newOffset != obj.offset && obj.body != nil {
+		obj.body.Close()
+		obj.body = nil
+	}
+	obj.offset = newOffset
+	return newOffset, nil
+}
+
+func (obj *s3Object) Close() error {
+	if obj.body == nil {
+		return nil
+	}
+	return obj.body.Close()
+}
+
+func s3Error(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// s3Escape URI encodes s the way AWS expects it in canonical requests.
+// Only unreserved characters are left alone, and slashes are kept when
+// encoding object keys.
+func s3Escape(s string, keepSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			sb.WriteByte(b)
+		case b == '/' && keepSlash:
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// MaxTags is how many tags a gallery can have.
+	MaxTags = 20
+	// maxTagLength is the length of the longest tag, in characters.
+	maxTagLength = 50
+	// maxSearchResults is how many galleries a search returns.
+	maxSearchResults = 50
+)
+
+// ParseTags turns the tags a user typed, separated by commas, into the
+// Tags of a gallery. Tags are lower cased and spaces inside a tag become
+// dashes, so "New York, new york" is the single tag "new-york".
+func ParseTags(s string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.ToLower(strings.Join(strings.Fields(tag), "-"))
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			tag = string([]rune(tag)[:maxTagLength])
+		}
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+		if len(tags) == MaxTags {
+			break
+		}
+	}
+	return tags
+}
+
+// Search looks for galleries matching query in their title, tags,
+// description or image captions, best matches first. query supports the
+// usual search engine syntax, like "quoted phrases" and -excluded words.
+// If tag isn't empty only galleries with that tag are returned, and
+// either can be empty.
+//
+// Only galleries the viewer may see are searched: their own galleries and
+// public galleries without a password. Unlisted galleries are meant to be
+// found through their link only. viewerID is 0 for visitors who aren't
+// signed in.
+func (service *GalleryService) Search(viewerID int, query,
+	tag string) ([]Gallery, error) {
+	query = strings.TrimSpace(query)
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if query == "" && tag == "" {
+		return nil, nil
+	}
+
+	rows, err := service.DB.Query(`
+		WITH search AS (
+			SELECT websearch_to_tsquery('english', $2) AS query
+		)
+		SELECT `+galleryColumns+`
+		FROM (
+			SELECT galleries.*,
+				ts_rank(galleries.search_vector, search.query) +
+				COALESCE((
+					SELECT MAX(ts_rank(images.search_vector, search.query))
+					FROM images
+					WHERE images.gallery_id = galleries.id
+						AND images.search_vector @@ search.query), 0) AS rank
+			FROM galleries, search
+			WHERE (galleries.user_id = $1
+				OR (galleries.visibility = $4 AND galleries.password_hash = ''))
+				AND ($3 = '' OR $3 = ANY (string_to_array(galleries.tags, ' ')))
+				AND ($2 = ''
+					OR galleries.search_vector @@ search.query
+					OR EXISTS (
+						SELECT 1 FROM images
+						WHERE images.gallery_id = galleries.id
+							AND images.search_vector @@ search.query))
+		) AS results
+		ORDER BY rank DESC, id DESC
+		LIMIT $5;`, viewerID, query, tag, VisibilityPublic, maxSearchResults)
+	if err != nil {
+		return nil, fmt.Errorf("search galleries: %w", err)
+	}
+	defer rows.Close()
+
+	var galleries []Gallery
+	for rows.Next() {
+		var gallery Gallery
+		err = scanGallery(rows, &gallery)
+		if err != nil {
+			return nil, fmt.Errorf("search galleries: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("search galleries: %w", err)
+	}
+	return galleries, nil
+}
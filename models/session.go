@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"fmt"
+	"time"
 
 	"github.com/etaseq/lenslocked/rand"
 )
@@ -12,6 +13,20 @@ import (
 const (
 	// The minimum number of bytes to be used for each session token.
 	MinBytesPerToken = 32
+
+	// How often the last_seen_at of a session is updated. Writing it on
+	// every single request would be a waste.
+	lastSeenInterval = time.Minute
+
+	// DefaultSessionDuration is how long a session lasts at most, no matter
+	// how active it is.
+	DefaultSessionDuration = 30 * 24 * time.Hour
+	// DefaultIdleTimeout is how long a session can go unused before it
+	// expires.
+	DefaultIdleTimeout = 7 * 24 * time.Hour
+	// PendingSessionDuration is how long a user has to enter their second
+	// factor after signing in with their password.
+	PendingSessionDuration = 10 * time.Minute
 )
 
 type Session struct {
@@ -21,8 +36,26 @@ type Session struct {
 	// When look up a session this will be left empty,
 	// as I only store the hash of a session token in our
 	// database and we cannot reverse it into a raw token
-	Token     string
-	TokenHash string
+	Token      string
+	TokenHash  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	// UserAgent and IPAddress describe the device that signed in, so that
+	// users can tell their sessions apart.
+	UserAgent string
+	IPAddress string
+	// Current is set by List for the session making the request.
+	Current bool
+	// ExpiresAt is when the session expires unless it is used again. It
+	// is never later than CreatedAt plus the SessionService Duration.
+	ExpiresAt time.Time
+	// TwoFactorPending marks a half-session: the password was correct but
+	// the second factor hasn't been checked yet. These sessions are only
+	// good for finishing the sign in.
+	TwoFactorPending bool
+	// Renewed is set by UserSession when using the session pushed its
+	// ExpiresAt further into the future.
+	Renewed bool
 }
 
 type SessionService struct {
@@ -31,9 +64,32 @@ type SessionService struct {
 	// each session token. If this value is not set or is less than the
 	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be used.
 	BytesPerToken int
+	// Duration is the absolute lifetime of a session, sessions expire this
+	// long after signing in even if they are in use.
+	// Defaults to DefaultSessionDuration.
+	Duration time.Duration
+	// IdleTimeout is how long a session can go unused before it expires.
+	// Every use of the session slides this window forward.
+	// Defaults to DefaultIdleTimeout.
+	IdleTimeout time.Duration
 }
 
-func (ss *SessionService) Create(userID int) (*Session, error) {
+// Create a new session for the user. Every sign in gets its own session,
+// so being signed in on a phone doesn't sign the user out on their laptop.
+func (ss *SessionService) Create(userID int, userAgent, ipAddress string) (*Session,
+	error) {
+	return ss.create(userID, userAgent, ipAddress, false)
+}
+
+// CreatePending creates a half-session for a user with two-factor
+// authentication, which expires after PendingSessionDuration.
+func (ss *SessionService) CreatePending(userID int, userAgent,
+	ipAddress string) (*Session, error) {
+	return ss.create(userID, userAgent, ipAddress, true)
+}
+
+func (ss *SessionService) create(userID int, userAgent, ipAddress string,
+	pending bool) (*Session, error) {
 	bytesPerToken := ss.BytesPerToken
 	if bytesPerToken < MinBytesPerToken {
 		bytesPerToken = MinBytesPerToken
@@ -45,47 +101,47 @@ func (ss *SessionService) Create(userID int) (*Session, error) {
 	}
 
 	session := Session{
-		UserID:    userID,
-		Token:     token,
-		TokenHash: ss.hash(token),
+		UserID:           userID,
+		Token:            token,
+		TokenHash:        ss.hash(token),
+		UserAgent:        userAgent,
+		IPAddress:        ipAddress,
+		TwoFactorPending: pending,
 	}
 
-	// The Create method is also used for Signin so I will need
-	// to be able to update the sessions too.
-	// 1. Try to UPDATE the user's session
-	// 2. If err, create new session
-	//row := ss.DB.QueryRow(`
-	//	UPDATE sessions
-	//	SET token_hash = $2
-	//	WHERE user_id = $1
-	//	RETURNING id;`, session.UserID, session.TokenHash)
-	//err = row.Scan(&session.ID)
-
-	//if err == sql.ErrNoRows {
-	//	row = ss.DB.QueryRow(`
-	//		INSERT INTO sessions (user_id, token_hash)
-	//		VALUES ($1, $2)
-	//		RETURNING id;`, session.UserID, session.TokenHash)
-	//	err = row.Scan(&session.ID)
-	//}
-
-	// Short version of the 1. and 2. using Postgres ON CONFLICT
+	// Before users could have more than one session this was an upsert
+	// (INSERT ... ON CONFLICT (user_id) DO UPDATE), replacing the token of
+	// the existing session on every sign in.
 	row := ss.DB.QueryRow(`
-		INSERT INTO sessions (user_id, token_hash)
-		VALUES ($1, $2) ON CONFLICT (user_id) DO
-		UPDATE
-		SET token_hash = $2
-		RETURNING id;`, session.UserID, session.TokenHash)
-	err = row.Scan(&session.ID)
+		INSERT INTO sessions (user_id, token_hash, user_agent, ip_address,
+			two_factor_pending)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, last_seen_at;`, session.UserID,
+		session.TokenHash, session.UserAgent, session.IPAddress,
+		session.TwoFactorPending)
+	err = row.Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt)
 
 	if err != nil {
 		return nil, fmt.Errorf("create: %w", err)
 	}
+	session.ExpiresAt = ss.expiresAt(session)
 
 	return &session, nil
 }
 
 func (ss *SessionService) User(token string) (*User, error) {
+	user, _, err := ss.UserSession(token)
+	if err != nil {
+		return nil, fmt.Errorf("user: %w", err)
+	}
+	return user, nil
+}
+
+// UserSession looks up the session for token and the user it belongs to.
+// Expired sessions are deleted and ErrSessionExpired is returned. Using a
+// session slides its idle timeout forward, in which case the returned
+// Session is marked as Renewed so the cookie can be renewed as well.
+func (ss *SessionService) UserSession(token string) (*User, *Session, error) {
 	// 1. Hash the session token
 	tokenHash := ss.hash(token)
 
@@ -111,20 +167,57 @@ func (ss *SessionService) User(token string) (*User, error) {
 
 	// Short version of 2. and 3. using JOIN
 	var user User
+	session := Session{
+		Token:     token,
+		TokenHash: tokenHash,
+	}
 	row := ss.DB.QueryRow(`
-		SELECT users.id,
+		SELECT sessions.id,
+			sessions.created_at,
+			sessions.last_seen_at,
+			sessions.two_factor_pending,
+			users.id,
 			users.email,
-			users.password_hash
+			users.password_hash,
+			users.email_verified_at
 		FROM sessions
 			JOIN users ON users.id = sessions.user_id
 		WHERE sessions.token_hash = $1;`, tokenHash)
-	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+	err := row.Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt,
+		&session.TwoFactorPending, &user.ID, &user.Email, &user.PasswordHash, &user.EmailVerifiedAt)
 	if err != nil {
-		return nil, fmt.Errorf("user: %w", err)
+		return nil, nil, fmt.Errorf("user session: %w", err)
+	}
+	session.UserID = user.ID
+
+	// 3. Make sure the session is still valid
+	session.ExpiresAt = ss.expiresAt(session)
+	if time.Now().After(session.ExpiresAt) {
+		err = ss.Delete(token)
+		if err != nil {
+			return nil, nil, fmt.Errorf("user session: %w", err)
+		}
+		return nil, nil, ErrSessionExpired
+	}
+
+	// Keep track of when the session was last used, which both shows up in
+	// the list of sessions and renews the idle timeout.
+	if time.Since(session.LastSeenAt) > lastSeenInterval {
+		row = ss.DB.QueryRow(`
+			UPDATE sessions
+			SET last_seen_at = now()
+			WHERE id = $1
+			RETURNING last_seen_at;`, session.ID)
+		err = row.Scan(&session.LastSeenAt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("user session: %w", err)
+		}
+		session.ExpiresAt = ss.expiresAt(session)
+		session.Renewed = true
 	}
 
 	// 4. Return the user
-	return &user, nil
+	return &user, &session, nil
 }
 
 func (ss *SessionService) Delete(token string) error {
@@ -142,6 +235,119 @@ func (ss *SessionService) Delete(token string) error {
 	return nil
 }
 
+// List returns all the sessions of a user, most recently used first.
+// The session belonging to currentToken is marked as Current.
+func (ss *SessionService) List(userID int, currentToken string) ([]Session,
+	error) {
+	rows, err := ss.DB.Query(`
+		SELECT id, token_hash, created_at, last_seen_at, user_agent, ip_address
+		FROM sessions
+		WHERE user_id = $1 AND NOT two_factor_pending
+		ORDER BY last_seen_at DESC;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list: %w", err)
+	}
+	defer rows.Close()
+
+	currentHash := ss.hash(currentToken)
+	var sessions []Session
+	for rows.Next() {
+		session := Session{
+			UserID: userID,
+		}
+		err = rows.Scan(&session.ID, &session.TokenHash, &session.CreatedAt,
+			&session.LastSeenAt, &session.UserAgent, &session.IPAddress)
+		if err != nil {
+			return nil, fmt.Errorf("list: %w", err)
+		}
+		session.Current = session.TokenHash == currentHash
+		session.ExpiresAt = ss.expiresAt(session)
+		sessions = append(sessions, session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("list: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// DeleteByID revokes a single session. The userID makes sure users can
+// only revoke their own sessions.
+func (ss *SessionService) DeleteByID(userID, sessionID int) error {
+	_, err := ss.DB.Exec(`
+		DELETE FROM sessions
+		WHERE id = $1 AND user_id = $2;`, sessionID, userID)
+	if err != nil {
+		return fmt.Errorf("delete by id: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteOthers revokes every session of the user except the one belonging
+// to currentToken, signing them out everywhere else.
+func (ss *SessionService) DeleteOthers(userID int, currentToken string) error {
+	_, err := ss.DB.Exec(`
+		DELETE FROM sessions
+		WHERE user_id = $1 AND token_hash <> $2;`, userID, ss.hash(currentToken))
+	if err != nil {
+		return fmt.Errorf("delete others: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteExpired deletes every session that has either reached its absolute
+// lifetime or has been idle for too long. It is run periodically by the
+// Sweeper.
+func (ss *SessionService) DeleteExpired() (int64, error) {
+	now := time.Now()
+	result, err := ss.DB.Exec(`
+		DELETE FROM sessions
+		WHERE created_at < $1 OR last_seen_at < $2
+			OR (two_factor_pending AND created_at < $3);`,
+		now.Add(-ss.duration()), now.Add(-ss.idleTimeout()),
+		now.Add(-PendingSessionDuration))
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sessions: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sessions: %w", err)
+	}
+	return n, nil
+}
+
+// expiresAt returns whichever comes first, the end of the absolute lifetime
+// of the session or of its idle timeout.
+func (ss *SessionService) expiresAt(session Session) time.Time {
+	if session.TwoFactorPending {
+		return session.CreatedAt.Add(PendingSessionDuration)
+	}
+	absolute := session.CreatedAt.Add(ss.duration())
+	idle := session.LastSeenAt.Add(ss.idleTimeout())
+	if idle.Before(absolute) {
+		return idle
+	}
+	return absolute
+}
+
+func (ss *SessionService) duration() time.Duration {
+	if ss.Duration == 0 {
+		return DefaultSessionDuration
+	}
+	return ss.Duration
+}
+
+func (ss *SessionService) idleTimeout() time.Duration {
+	if ss.IdleTimeout == 0 {
+		return DefaultIdleTimeout
+	}
+	return ss.IdleTimeout
+}
+
 // I do hash instead of Hash because I do not want this function
 // to be used outside of this scope.
 func (ss *SessionService) hash(token string) string {
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultSweepInterval = 10 * time.Minute
+)
+
+// Expirer is implemented by services that store rows which expire, like
+// sessions and password resets.
+type Expirer interface {
+	// DeleteExpired deletes the expired rows and returns how many were
+	// deleted.
+	DeleteExpired() (int64, error)
+}
+
+// Sweeper periodically deletes expired rows so they don't pile up in the
+// database. Expired rows are already rejected when they are used, this is
+// only about cleaning up.
+type Sweeper struct {
+	Expirers []Expirer
+	// Interval is how often the Sweeper runs.
+	// Defaults to DefaultSweepInterval.
+	Interval time.Duration
+
+	stop chan struct{}
+}
+
+// Start runs the Sweeper in the background until Stop is called.
+func (s *Sweeper) Start() {
+	interval := s.Interval
+	if interval == 0 {
+		interval = DefaultSweepInterval
+	}
+	s.stop = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			s.sweep()
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *Sweeper) Stop() {
+	close(s.stop)
+}
+
+func (s *Sweeper) sweep() {
+	for _, expirer := range s.Expirers {
+		_, err := expirer.DeleteExpired()
+		// There is nobody to return the error to. The next run will try
+		// again anyway.
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
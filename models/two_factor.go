@@ -0,0 +1,370 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/etaseq/lenslocked/rand"
+)
+
+const (
+	// TOTPIssuer is the name authenticator apps show next to the code.
+	TOTPIssuer = "LensLocked"
+	// RecoveryCodeCount is how many recovery codes a user gets at a time.
+	RecoveryCodeCount = 10
+
+	// These are the defaults every authenticator app understands
+	// (RFC 6238): 6 digit codes from HMAC-SHA1, changing every 30 seconds.
+	totpPeriod      = 30
+	totpDigits      = 6
+	totpSecretBytes = 20
+	// totpSkew is the number of periods before and after the current one
+	// that are accepted, to make up for clocks that are a bit off.
+	totpSkew = 1
+
+	recoveryCodeBytes = 10
+)
+
+// base32 without padding is what authenticator apps expect secrets in.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment is what a user needs to add their account to an
+// authenticator app.
+type TOTPEnrollment struct {
+	Secret string
+	// URI is the otpauth:// provisioning URI, usually shown as a QR code.
+	URI string
+}
+
+// TwoFactorService manages time-based one-time passwords (TOTP) and the
+// recovery codes that can be used instead of them.
+type TwoFactorService struct {
+	DB *sql.DB
+}
+
+// Enabled reports whether the user has two-factor authentication enabled.
+func (service *TwoFactorService) Enabled(userID int) (bool, error) {
+	var enabled bool
+	row := service.DB.QueryRow(`
+		SELECT totp_enabled_at IS NOT NULL
+		FROM users WHERE id = $1;`, userID)
+	err := row.Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("two-factor enabled: %w", err)
+	}
+	return enabled, nil
+}
+
+// Setup generates a new secret for the user. Two-factor authentication
+// isn't enabled until Enable is called with a code generated from it, so
+// starting over simply replaces the secret.
+func (service *TwoFactorService) Setup(user *User) (*TOTPEnrollment, error) {
+	secret, err := rand.Bytes(totpSecretBytes)
+	if err != nil {
+		return nil, fmt.Errorf("setup: %w", err)
+	}
+	encoded := totpEncoding.EncodeToString(secret)
+
+	result, err := service.DB.Exec(`
+		UPDATE users
+		SET totp_secret = $2, totp_last_step = 0
+		WHERE id = $1 AND totp_enabled_at IS NULL;`, user.ID, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("setup: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("setup: %w", err)
+	}
+	if n == 0 {
+		return nil, errors.New("setup: two-factor authentication is already enabled")
+	}
+
+	return service.enrollment(user.Email, encoded), nil
+}
+
+// Enrollment returns the enrollment started by Setup, so it can be shown
+// again when the user mistypes the confirmation code.
+func (service *TwoFactorService) Enrollment(user *User) (*TOTPEnrollment, error) {
+	var secret string
+	row := service.DB.QueryRow(`
+		SELECT totp_secret FROM users
+		WHERE id = $1 AND totp_enabled_at IS NULL;`, user.ID)
+	err := row.Scan(&secret)
+	if err != nil {
+		return nil, fmt.Errorf("enrollment: %w", err)
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("enrollment: %w", ErrNotFound)
+	}
+	return service.enrollment(user.Email, secret), nil
+}
+
+// Enable turns on two-factor authentication once the user proves their
+// authenticator app is set up by entering a code from it. It returns a
+// fresh set of recovery codes, which are only ever available in plain
+// text here.
+func (service *TwoFactorService) Enable(userID int, code string) ([]string, error) {
+	var secret string
+	row := service.DB.QueryRow(`
+		SELECT totp_secret FROM users
+		WHERE id = $1 AND totp_enabled_at IS NULL;`, userID)
+	err := row.Scan(&secret)
+	if err != nil {
+		return nil, fmt.Errorf("enable: %w", err)
+	}
+
+	step, ok := totpStep(secret, code, 0, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	_, err = service.DB.Exec(`
+		UPDATE users
+		SET totp_enabled_at = now(), totp_last_step = $2
+		WHERE id = $1;`, userID, step)
+	if err != nil {
+		return nil, fmt.Errorf("enable: %w", err)
+	}
+
+	codes, err := service.RegenerateRecoveryCodes(userID)
+	if err != nil {
+		return nil, fmt.Errorf("enable: %w", err)
+	}
+	return codes, nil
+}
+
+// Disable turns off two-factor authentication and throws away the secret
+// and recovery codes.
+func (service *TwoFactorService) Disable(userID int) error {
+	_, err := service.DB.Exec(`
+		UPDATE users
+		SET totp_secret = '', totp_enabled_at = NULL, totp_last_step = 0
+		WHERE id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("disable: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+		DELETE FROM recovery_codes
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("disable: %w", err)
+	}
+	return nil
+}
+
+// Verify checks the second factor of a user signing in. The code can
+// either come from their authenticator app or be one of their recovery
+// codes. Every code only works once, otherwise ErrInvalidCode is returned.
+func (service *TwoFactorService) Verify(userID int, code string) error {
+	code = normalizeCode(code)
+	if len(code) == totpDigits {
+		return service.verifyTOTP(userID, code)
+	}
+	return service.useRecoveryCode(userID, code)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of the user, used or
+// not, with new ones.
+func (service *TwoFactorService) RegenerateRecoveryCodes(userID int) ([]string,
+	error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM recovery_codes
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+
+	codes := make([]string, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b, err := rand.Bytes(recoveryCodeBytes)
+		if err != nil {
+			return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+
+		_, err = tx.Exec(`
+			INSERT INTO recovery_codes (user_id, code_hash)
+			VALUES ($1, $2);`, userID, service.hash(code))
+		if err != nil {
+			return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+		}
+		codes = append(codes, formatRecoveryCode(code))
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+	return codes, nil
+}
+
+// RecoveryCodesLeft returns how many unused recovery codes the user has.
+func (service *TwoFactorService) RecoveryCodesLeft(userID int) (int, error) {
+	var n int
+	row := service.DB.QueryRow(`
+		SELECT COUNT(*) FROM recovery_codes
+		WHERE user_id = $1 AND used_at IS NULL;`, userID)
+	err := row.Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("recovery codes left: %w", err)
+	}
+	return n, nil
+}
+
+func (service *TwoFactorService) verifyTOTP(userID int, code string) error {
+	var secret string
+	var lastStep int64
+	row := service.DB.QueryRow(`
+		SELECT totp_secret, totp_last_step FROM users
+		WHERE id = $1 AND totp_enabled_at IS NOT NULL;`, userID)
+	err := row.Scan(&secret, &lastStep)
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+
+	step, ok := totpStep(secret, code, lastStep, time.Now())
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	// The condition on totp_last_step makes sure two requests racing with
+	// the same code can't both succeed.
+	result, err := service.DB.Exec(`
+		UPDATE users
+		SET totp_last_step = $2
+		WHERE id = $1 AND totp_last_step < $2;`, userID, step)
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	if n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+func (service *TwoFactorService) useRecoveryCode(userID int, code string) error {
+	result, err := service.DB.Exec(`
+		UPDATE recovery_codes
+		SET used_at = now()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;`,
+		userID, service.hash(code))
+	if err != nil {
+		return fmt.Errorf("use recovery code: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("use recovery code: %w", err)
+	}
+	if n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+func (service *TwoFactorService) enrollment(email, secret string) *TOTPEnrollment {
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {TOTPIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + TOTPIssuer + ":" + email,
+		RawQuery: query.Encode(),
+	}
+	return &TOTPEnrollment{
+		Secret: secret,
+		URI:    uri.String(),
+	}
+}
+
+// Recovery codes are random, so unlike passwords a fast hash is enough.
+func (service *TwoFactorService) hash(code string) string {
+	codeHash := sha256.Sum256([]byte(code))
+	return base64.URLEncoding.EncodeToString(codeHash[:])
+}
+
+// totpStep returns the time step code was generated for, if it is valid
+// for secret around now. Codes for lastStep, the step of the last code
+// that was used, or before it are rejected so a code can't be replayed.
+func totpStep(secret, code string, lastStep int64, now time.Time) (int64,
+	bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	first := max(current-totpSkew, lastStep+1)
+	for step := first; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode implements the HOTP algorithm from RFC 4226 using the time
+// step as the counter.
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation: the last nibble picks which 4 bytes to use.
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// normalizeCode lets users type codes with spaces, dashes or in upper
+// case.
+func normalizeCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// formatRecoveryCode splits a code in groups of 4 to make it easier to
+// copy by hand.
+func formatRecoveryCode(code string) string {
+	var groups []string
+	for len(code) > 4 {
+		groups = append(groups, code[:4])
+		code = code[4:]
+	}
+	groups = append(groups, code)
+	return strings.Join(groups, "-")
+}
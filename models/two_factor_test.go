@@ -0,0 +1,79 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+// The secret of the SHA-1 test vectors in RFC 6238.
+var rfcSecret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	// The RFC uses 8 digits, these are the last 6 of them.
+	tests := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range tests {
+		got := totpCode([]byte("12345678901234567890"), unix/totpPeriod)
+		if got != want {
+			t.Errorf("totpCode() at %d = %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestTOTPStep(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+	key := []byte("12345678901234567890")
+	code := func(step int64) string { return totpCode(key, step) }
+
+	tests := map[string]struct {
+		secret   string
+		code     string
+		lastStep int64
+		// want is the accepted step, 0 if the code must be rejected.
+		want int64
+	}{
+		"current":               {rfcSecret, code(current), 0, current},
+		"previous":              {rfcSecret, code(current - 1), 0, current - 1},
+		"next":                  {rfcSecret, code(current + 1), 0, current + 1},
+		"too old":               {rfcSecret, code(current - 2), 0, 0},
+		"too far ahead":         {rfcSecret, code(current + 2), 0, 0},
+		"newer than last used":  {rfcSecret, code(current), current - 1, current},
+		"replayed":              {rfcSecret, code(current), current, 0},
+		"older than last used":  {rfcSecret, code(current - 1), current, 0},
+		"after a future code":   {rfcSecret, code(current), current + 1, 0},
+		"wrong code":            {rfcSecret, "000000", 0, 0},
+		"too short":             {rfcSecret, code(current)[:5], 0, 0},
+		"too long":              {rfcSecret, code(current) + "0", 0, 0},
+		"invalid secret":        {"not base32!", code(current), 0, 0},
+		"another secret":        {totpEncoding.EncodeToString([]byte("another secret")), code(current), 0, 0},
+		"empty code and secret": {"", "", 0, 0},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			step, ok := totpStep(tc.secret, tc.code, tc.lastStep, now)
+			if ok != (tc.want != 0) || step != tc.want {
+				t.Errorf("totpStep() = %d, %v, want %d", step, ok, tc.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeCode(t *testing.T) {
+	tests := map[string]string{
+		"123 456":             "123456",
+		"ABCD-EFGH-IJKL-MNOP": "abcdefghijklmnop",
+		" abcd efgh ":         "abcdefgh",
+	}
+	for code, want := range tests {
+		if got := normalizeCode(code); got != want {
+			t.Errorf("normalizeCode(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/etaseq/lenslocked/rand"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+const (
+	// DefaultMaxUploadSize is the largest file a resumable upload accepts.
+	// Anything larger wouldn't become an image anyway.
+	DefaultMaxUploadSize = MaxImageSize
+	// DefaultUploadDuration is how long an incomplete upload is kept after
+	// the last chunk was received.
+	DefaultUploadDuration = 24 * time.Hour
+
+	// uploadTokenBytes is the size of the random part of upload URLs.
+	uploadTokenBytes = 16
+	// maxChunkSize is the most Append reads from a single request. Chunks
+	// are buffered before they are stored, so this bounds the memory a
+	// request takes. Clients sending more are told how much was received
+	// and continue from there.
+	maxChunkSize = 8 << 20
+	// uploadsDir is where the chunks are kept in the ImageStore.
+	uploadsDir = "uploads"
+)
+
+// Upload is a file that is being uploaded in chunks, so that an upload
+// interrupted by a flaky connection can be resumed instead of starting
+// over. Once all Length bytes are received it becomes an image.
+type Upload struct {
+	ID int
+	// Token identifies the upload in its URL.
+	Token     string
+	UserID    int
+	GalleryID int
+	Filename  string
+	// Length is the size of the whole file and Offset how much of it has
+	// been received so far.
+	Length    int64
+	Offset    int64
+	CreatedAt time.Time
+	ExpiresAt time.Time
+
+	// tx holds the row lock while the upload is locked.
+	tx *sql.Tx
+}
+
+// Complete reports whether every byte of the file has been received.
+func (u Upload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+// UploadService keeps track of resumable uploads. Object stores can't
+// append to a file, so every chunk is stored as an object of its own in
+// the ImageStore and the chunks are read back in order once the upload
+// is complete. Both the chunks and the state of the upload are shared
+// by all instances of the app, so the chunks of an upload can land on
+// any of them.
+type UploadService struct {
+	DB *sql.DB
+	// Store is where the received chunks are kept, usually the same
+	// ImageStore the GalleryService uses.
+	Store ImageStore
+	// MaxSize is the largest file that can be uploaded, up to
+	// MaxImageSize. Defaults to DefaultMaxUploadSize.
+	MaxSize int64
+	// Duration is how long an upload can go without receiving a chunk
+	// before it expires. Defaults to DefaultUploadDuration.
+	Duration time.Duration
+}
+
+// Create starts a new upload of a file with length bytes.
+func (service *UploadService) Create(userID, galleryID int, filename string,
+	length int64) (*Upload, error) {
+	if length <= 0 {
+		return nil, fmt.Errorf("create upload: invalid length %d", length)
+	}
+	if length > service.SizeLimit() {
+		return nil, fmt.Errorf("create upload: %w", ErrUploadTooLarge)
+	}
+
+	token, err := rand.String(uploadTokenBytes)
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+	upload := Upload{
+		Token:     token,
+		UserID:    userID,
+		GalleryID: galleryID,
+		Filename:  filename,
+		Length:    length,
+		ExpiresAt: time.Now().Add(service.duration()),
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO uploads (token, user_id, gallery_id, filename, length,
+			expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at;`, upload.Token, upload.UserID,
+		upload.GalleryID, upload.Filename, upload.Length, upload.ExpiresAt)
+	err = row.Scan(&upload.ID, &upload.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+	return &upload, nil
+}
+
+// ByToken returns one of the user's uploads. Expired uploads are reported
+// as ErrNotFound just like the ones that never existed.
+func (service *UploadService) ByToken(userID int, token string) (*Upload,
+	error) {
+	upload, err := service.byToken(service.DB, userID, token, "")
+	if err != nil {
+		return nil, fmt.Errorf("upload by token: %w", err)
+	}
+	return upload, nil
+}
+
+// Lock returns one of the user's uploads like ByToken, locked so that
+// only one request at a time works on it, whichever instance of the app
+// it lands on. Two requests writing at once would otherwise mix up the
+// bytes of two chunks. ErrUploadLocked is returned if another request
+// holds the lock. The lock is the row lock of a transaction, which is
+// released by Unlock or Delete.
+func (service *UploadService) Lock(userID int, token string) (*Upload,
+	error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("lock upload: %w", err)
+	}
+	// NOWAIT makes a second request fail right away instead of waiting
+	// for the first chunk to be received.
+	upload, err := service.byToken(tx, userID, token, "FOR UPDATE NOWAIT")
+	if err != nil {
+		tx.Rollback()
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.LockNotAvailable {
+			return nil, fmt.Errorf("lock upload: %w", ErrUploadLocked)
+		}
+		return nil, fmt.Errorf("lock upload: %w", err)
+	}
+	upload.tx = tx
+	return upload, nil
+}
+
+// Unlock commits what was done to a locked upload and releases the lock.
+// Unlocking an upload that isn't locked does nothing, so it can be
+// deferred right after Lock.
+func (service *UploadService) Unlock(upload *Upload) error {
+	if upload.tx == nil {
+		return nil
+	}
+	err := upload.tx.Commit()
+	upload.tx = nil
+	if err != nil {
+		return fmt.Errorf("unlock upload: %w", err)
+	}
+	return nil
+}
+
+// byToken looks up an upload with q, which is either the DB or the
+// transaction of a lock. suffix is appended to the query.
+func (service *UploadService) byToken(q queryRower, userID int, token,
+	suffix string) (*Upload, error) {
+	upload := Upload{
+		Token:  token,
+		UserID: userID,
+	}
+	row := q.QueryRow(`
+		SELECT id, gallery_id, filename, length, bytes_received, created_at,
+			expires_at
+		FROM uploads
+		WHERE token = $1 AND user_id = $2 `+suffix+`;`, token, userID)
+	err := row.Scan(&upload.ID, &upload.GalleryID, &upload.Filename,
+		&upload.Length, &upload.Offset, &upload.CreatedAt, &upload.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return &upload, nil
+}
+
+// Append stores the next chunk of the file, read from r, for an upload
+// the caller has locked. offset is where the client thinks the chunk
+// starts and must match the Offset of the upload, otherwise
+// ErrUploadOffset is returned. At most maxChunkSize bytes are read. If
+// reading the chunk fails half way, for example because the connection
+// dropped, the bytes that made it are still kept so the client can
+// resume from there.
+func (service *UploadService) Append(upload *Upload, offset int64,
+	r io.Reader) error {
+	if upload.tx == nil {
+		return fmt.Errorf("append upload: upload %v is not locked", upload.ID)
+	}
+	if offset != upload.Offset {
+		return fmt.Errorf("append upload: %w", ErrUploadOffset)
+	}
+
+	// Anything past the announced length is ignored.
+	chunk, readErr := io.ReadAll(io.LimitReader(r,
+		min(upload.Length-upload.Offset, maxChunkSize)))
+	if len(chunk) == 0 {
+		if readErr != nil {
+			return fmt.Errorf("append upload: %w", readErr)
+		}
+		return nil
+	}
+
+	// A previous request might have stored a chunk at this offset that it
+	// never got to record, which is replaced. Chunks are only ever stored
+	// at the Offset of the upload, so every chunk before it is one that
+	// was recorded.
+	err := service.Store.Put(chunkKey(upload.Token, upload.Offset),
+		bytes.NewReader(chunk))
+	if err != nil {
+		return fmt.Errorf("append upload: %w", err)
+	}
+
+	row := upload.tx.QueryRow(`
+		UPDATE uploads
+		SET bytes_received = bytes_received + $2, expires_at = $3
+		WHERE id = $1
+		RETURNING bytes_received, expires_at;`, upload.ID, len(chunk),
+		time.Now().Add(service.duration()))
+	err = row.Scan(&upload.Offset, &upload.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("append upload: %w", err)
+	}
+	if readErr != nil {
+		return fmt.Errorf("append upload: %w", readErr)
+	}
+	return nil
+}
+
+// Open returns the received bytes of an upload, read chunk by chunk from
+// the ImageStore. Callers need to close the returned reader.
+func (service *UploadService) Open(upload *Upload) (io.ReadSeekCloser,
+	error) {
+	keys, err := service.chunkKeys(upload.Token)
+	if err != nil {
+		return nil, fmt.Errorf("open upload: %w", err)
+	}
+	reader := uploadReader{
+		store:  service.Store,
+		length: upload.Offset,
+	}
+	for _, key := range keys {
+		start := chunkOffset(key)
+		// A chunk that was stored but never recorded.
+		if start >= upload.Offset {
+			continue
+		}
+		reader.keys = append(reader.keys, key)
+		reader.starts = append(reader.starts, start)
+	}
+	if upload.Offset > 0 && (len(reader.starts) == 0 || reader.starts[0] != 0) {
+		return nil, fmt.Errorf("open upload: first chunk: %w", ErrNotFound)
+	}
+	return &reader, nil
+}
+
+// Delete removes an upload the caller has locked along with the chunks
+// received so far, either because it was cancelled or because it was
+// turned into an image. This releases the lock as well.
+func (service *UploadService) Delete(upload *Upload) error {
+	if upload.tx == nil {
+		return fmt.Errorf("delete upload: upload %v is not locked", upload.ID)
+	}
+	_, err := upload.tx.Exec(`
+		DELETE FROM uploads
+		WHERE id = $1;`, upload.ID)
+	if err != nil {
+		return fmt.Errorf("delete upload: %w", err)
+	}
+	err = service.Unlock(upload)
+	if err != nil {
+		return fmt.Errorf("delete upload: %w", err)
+	}
+	// Chunks left behind are removed by DeleteExpired.
+	err = service.deleteChunks(upload.Token)
+	if err != nil {
+		return fmt.Errorf("delete upload: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired deletes the uploads nobody finished in time. It is run
+// periodically by the Sweeper.
+func (service *UploadService) DeleteExpired() (int64, error) {
+	// The chunks are listed before looking up the uploads, since uploads
+	// are created before their first chunk is stored. That way the chunks
+	// of an upload created in between aren't taken for leftovers.
+	keys, err := service.Store.List(uploadsDir)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired uploads: %w", err)
+	}
+
+	result, err := service.DB.Exec(`
+		DELETE FROM uploads
+		WHERE expires_at < $1;`, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("delete expired uploads: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired uploads: %w", err)
+	}
+
+	// Any chunk without an upload is a leftover, be it of an expired
+	// upload, of one that was deleted along with its gallery or user, or
+	// of one Delete didn't get to clean up.
+	rows, err := service.DB.Query(`
+		SELECT token
+		FROM uploads;`)
+	if err != nil {
+		return n, fmt.Errorf("delete expired uploads: %w", err)
+	}
+	defer rows.Close()
+	tokens := make(map[string]bool)
+	for rows.Next() {
+		var token string
+		err = rows.Scan(&token)
+		if err != nil {
+			return n, fmt.Errorf("delete expired uploads: %w", err)
+		}
+		tokens[token] = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return n, fmt.Errorf("delete expired uploads: %w", err)
+	}
+
+	for _, key := range keys {
+		if tokens[chunkToken(key)] {
+			continue
+		}
+		err = service.Store.Delete(key)
+		if err != nil {
+			return n, fmt.Errorf("delete expired uploads: %w", err)
+		}
+	}
+	return n, nil
+}
+
+// chunkKeys returns the keys of the chunks stored for an upload, ordered
+// by their offset.
+func (service *UploadService) chunkKeys(token string) ([]string, error) {
+	keys, err := service.Store.List(uploadsDir)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []string
+	for _, key := range keys {
+		if chunkToken(key) == token {
+			chunks = append(chunks, key)
+		}
+	}
+	// The offsets are zero padded, so sorting the keys sorts the offsets.
+	sort.Strings(chunks)
+	return chunks, nil
+}
+
+func (service *UploadService) deleteChunks(token string) error {
+	keys, err := service.chunkKeys(token)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = service.Store.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkKey returns the key of the chunk of an upload starting at offset.
+// Tokens are base64url, so they never contain the dot.
+func chunkKey(token string, offset int64) string {
+	return fmt.Sprintf("%s/%s.%020d", uploadsDir, token, offset)
+}
+
+// chunkToken returns the token of the upload a chunk belongs to.
+func chunkToken(key string) string {
+	token, _, _ := strings.Cut(path.Base(key), ".")
+	return token
+}
+
+// chunkOffset returns where in the file a chunk starts, or -1 if key
+// isn't the key of a chunk.
+func chunkOffset(key string) int64 {
+	_, offset, _ := strings.Cut(path.Base(key), ".")
+	n, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// uploadReader reads the chunks of an upload as one file. Chunks are
+// opened one at a time as the reading gets to them, so only one of them
+// is ever open.
+type uploadReader struct {
+	store ImageStore
+	// keys are the chunks and starts where each of them starts in the
+	// file. The last chunk ends at length.
+	keys   []string
+	starts []int64
+	length int64
+
+	pos int64
+	// chunk is the open chunk, the one with index current.
+	chunk   *ImageFile
+	current int
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	if r.chunk == nil {
+		// The last chunk starting at or before pos.
+		i := sort.Search(len(r.starts), func(i int) bool {
+			return r.starts[i] > r.pos
+		}) - 1
+		chunk, err := r.store.Open(r.keys[i])
+		if err != nil {
+			return 0, err
+		}
+		_, err = chunk.Seek(r.pos-r.starts[i], io.SeekStart)
+		if err != nil {
+			chunk.Close()
+			return 0, err
+		}
+		r.chunk = chunk
+		r.current = i
+	}
+
+	end := r.length
+	if r.current+1 < len(r.starts) {
+		end = r.starts[r.current+1]
+	}
+	n, err := r.chunk.Read(p[:min(int64(len(p)), end-r.pos)])
+	r.pos += int64(n)
+	if r.pos == end || err == io.EOF {
+		if r.pos != end {
+			return n, fmt.Errorf("chunk %v: %w", r.keys[r.current],
+				io.ErrUnexpectedEOF)
+		}
+		r.chunk.Close()
+		r.chunk = nil
+		err = nil
+	}
+	return n, err
+}
+
+func (r *uploadReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		return 0, errors.New("upload reader: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("upload reader: negative position")
+	}
+	if r.chunk != nil {
+		r.chunk.Close()
+		r.chunk = nil
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *uploadReader) Close() error {
+	if r.chunk == nil {
+		return nil
+	}
+	err := r.chunk.Close()
+	r.chunk = nil
+	return err
+}
+
+// SizeLimit returns the largest file that can be uploaded.
+func (service *UploadService) SizeLimit() int64 {
+	if service.MaxSize <= 0 || service.MaxSize > MaxImageSize {
+		return DefaultMaxUploadSize
+	}
+	return service.MaxSize
+}
+
+func (service *UploadService) duration() time.Duration {
+	if service.Duration <= 0 {
+		return DefaultUploadDuration
+	}
+	return service.Duration
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
@@ -15,10 +16,34 @@ type User struct {
 	ID           int
 	Email        string
 	PasswordHash string
+	// EmailVerifiedAt is nil until the user clicks the link in the
+	// verification email.
+	EmailVerifiedAt *time.Time
 }
 
+// EmailVerified reports whether the user proved they own their email
+// address.
+func (u User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+const (
+	// DefaultMaxFailedSignIns is how many wrong passwords in a row from
+	// one IP address lock an account for that address.
+	DefaultMaxFailedSignIns = 10
+	// DefaultLockoutDuration is how long an account stays locked.
+	DefaultLockoutDuration = 15 * time.Minute
+)
+
 type UserService struct {
 	DB *sql.DB
+	// MaxFailedSignIns is how many wrong passwords in a row from one IP
+	// address temporarily lock an account for that address. Defaults to
+	// DefaultMaxFailedSignIns.
+	MaxFailedSignIns int
+	// LockoutDuration is how long a locked account can't be signed in to.
+	// Defaults to DefaultLockoutDuration.
+	LockoutDuration time.Duration
 }
 
 // Create a new user. Notice that I return a *User pointer.
@@ -68,30 +93,105 @@ func (us *UserService) Create(email, password string) (*User, error) {
 	return &user, err
 }
 
-func (us *UserService) Authenticate(email, password string) (*User, error) {
+// Authenticate checks the password of the user with the given email,
+// coming from the IP address ip. It returns ErrNotFound for unknown emails
+// and ErrWrongPassword for wrong passwords. Too many wrong passwords in a
+// row lock the account for a while, during which ErrAccountLocked is
+// returned even for the right password. The lock only applies to the IP
+// address the wrong passwords came from, otherwise anyone knowing an
+// email could keep its owner from signing in. Guessing from many
+// addresses is what the rate limiters in the controllers are for.
+func (us *UserService) Authenticate(email, password, ip string) (*User, error) {
 	email = strings.ToLower(email)
 
 	user := User{
 		Email: email,
 	}
+	var failedSignIns int
+	var lockedUntil *time.Time
 
 	row := us.DB.QueryRow(`
-		SELECT id, password_hash
-		FROM users WHERE email=$1`, email)
-
-	err := row.Scan(&user.ID, &user.PasswordHash)
+		SELECT users.id,
+			users.password_hash,
+			COALESCE(signin_failures.failed_signins, 0),
+			signin_failures.locked_until
+		FROM users
+			LEFT JOIN signin_failures ON signin_failures.user_id = users.id
+				AND signin_failures.ip = $2
+		WHERE users.email = $1;`, email, ip)
+
+	err := row.Scan(&user.ID, &user.PasswordHash, &failedSignIns, &lockedUntil)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("authenticate: %w", ErrNotFound)
+		}
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
 
+	if lockedUntil != nil && time.Now().Before(*lockedUntil) {
+		return nil, fmt.Errorf("authenticate: %w", ErrAccountLocked)
+	}
+
 	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
 	if err != nil {
-		return nil, fmt.Errorf("authenticate: %w", err)
+		// Users who signed up with an external provider have no password
+		// hash at all until they set a password.
+		if !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) &&
+			!errors.Is(err, bcrypt.ErrHashTooShort) {
+			return nil, fmt.Errorf("authenticate: %w", err)
+		}
+		err = us.recordFailedSignIn(user.ID, ip)
+		if err != nil {
+			return nil, fmt.Errorf("authenticate: %w", err)
+		}
+		return nil, fmt.Errorf("authenticate: %w", ErrWrongPassword)
+	}
+
+	if failedSignIns > 0 || lockedUntil != nil {
+		_, err = us.DB.Exec(`
+			DELETE FROM signin_failures
+			WHERE user_id = $1 AND ip = $2;`, user.ID, ip)
+		if err != nil {
+			return nil, fmt.Errorf("authenticate: %w", err)
+		}
 	}
 
 	return &user, nil
 }
 
+// recordFailedSignIn counts a wrong password from ip and locks the account
+// for that address once there were too many in a row. The counter starts
+// over after locking so the next lockout needs just as many attempts.
+func (us *UserService) recordFailedSignIn(userID int, ip string) error {
+	maxFailed := us.MaxFailedSignIns
+	if maxFailed <= 0 {
+		maxFailed = DefaultMaxFailedSignIns
+	}
+	lockout := us.LockoutDuration
+	if lockout <= 0 {
+		lockout = DefaultLockoutDuration
+	}
+
+	_, err := us.DB.Exec(`
+		INSERT INTO signin_failures (user_id, ip, failed_signins, locked_until)
+		VALUES ($1, $2,
+			CASE WHEN 1 >= $3 THEN 0 ELSE 1 END,
+			CASE WHEN 1 >= $3 THEN $4::timestamptz END)
+		ON CONFLICT (user_id, ip) DO UPDATE
+		SET failed_signins = CASE
+				WHEN signin_failures.failed_signins + 1 >= $3 THEN 0
+				ELSE signin_failures.failed_signins + 1
+			END,
+			locked_until = CASE
+				WHEN signin_failures.failed_signins + 1 >= $3 THEN $4
+				ELSE signin_failures.locked_until
+			END;`, userID, ip, maxFailed, time.Now().Add(lockout))
+	if err != nil {
+		return fmt.Errorf("record failed sign in: %w", err)
+	}
+	return nil
+}
+
 func (us *UserService) UpdatePassword(userID int, password string) error {
 	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -0,0 +1,202 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	// MaxZipEntries is how many files a ZIP archive can hold.
+	MaxZipEntries = 1000
+	// MaxZipEntrySize is the largest file a ZIP archive can hold once it
+	// is uncompressed. Entries are read into memory one at a time, so this
+	// is the same limit as for images uploaded on their own.
+	MaxZipEntrySize = MaxImageSize
+	// MaxZipSize is how much a whole ZIP archive can hold uncompressed.
+	MaxZipSize = 2 << 30
+)
+
+// ImageResult is the outcome of adding a single file of a bulk upload.
+type ImageResult struct {
+	Filename string
+	// Image is the image that was created, nil when Err is set.
+	Image *Image
+	// Err is nil if the image was added. FileErrors are about the file
+	// itself and safe to show to the user, ErrDuplicateImage means the
+	// gallery already had the file so it was skipped.
+	Err error
+}
+
+// CreateImagesFromZip adds every image in a ZIP archive to a gallery.
+// Files that can't be added don't stop the others, the outcome of each
+// one is returned instead. An error is only returned when the archive
+// itself can't be read or holds too many files.
+//
+// Archives are never extracted to disk, each image is read into memory
+// and only its base name is used, so entries like "../../etc/passwd"
+// can't go anywhere they shouldn't. Entries are also read with a limit
+// instead of trusting the sizes the archive claims, to defuse zip bombs.
+func (service *GalleryService) CreateImagesFromZip(galleryID int,
+	r io.ReaderAt, size int64) ([]ImageResult, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("create images from zip: %w", ErrInvalidZip)
+	}
+
+	var entries []*zip.File
+	for _, entry := range archive.File {
+		if skipZipEntry(entry) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) > MaxZipEntries {
+		return nil, fmt.Errorf("create images from zip: %w: more than %d files",
+			ErrInvalidZip, MaxZipEntries)
+	}
+
+	var results []ImageResult
+	var total int64
+	for _, entry := range entries {
+		// ZIP archives made on Windows sometimes use backslashes.
+		filename := path.Base(strings.ReplaceAll(entry.Name, `\`, "/"))
+		result := ImageResult{
+			Filename: filename,
+		}
+
+		if total >= MaxZipSize {
+			result.Err = FileError{
+				Issue: "the archive holds too much data",
+			}
+		} else {
+			var n int64
+			result.Image, n, result.Err = service.createImageFromZip(galleryID,
+				filename, entry)
+			total += n
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (service *GalleryService) createImageFromZip(galleryID int,
+	filename string, entry *zip.File) (*Image, int64, error) {
+	// Check the name first, so files that are going to be rejected anyway
+	// are never uncompressed.
+	err := checkExtension(filename, service.extensions())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rc, err := entry.Open()
+	if err != nil {
+		return nil, 0, FileError{Issue: "the file is damaged"}
+	}
+	defer rc.Close()
+
+	contents, err := io.ReadAll(io.LimitReader(rc, MaxZipEntrySize+1))
+	n := int64(len(contents))
+	if err != nil {
+		return nil, n, FileError{Issue: "the file is damaged"}
+	}
+	if n > MaxZipEntrySize {
+		return nil, n, FileError{
+			Issue: fmt.Sprintf("the file is larger than %d MB",
+				MaxZipEntrySize>>20),
+		}
+	}
+
+	image, err := service.CreateImage(galleryID, filename,
+		bytes.NewReader(contents))
+	if err != nil {
+		var fileErr FileError
+		if errors.As(err, &fileErr) {
+			return nil, n, fileErr
+		}
+		return nil, n, err
+	}
+	return image, n, nil
+}
+
+// skipZipEntry reports whether an entry is something other than a file
+// the user meant to upload: folders, and the metadata macOS and Windows
+// add to archives they create.
+func skipZipEntry(entry *zip.File) bool {
+	name := strings.ReplaceAll(entry.Name, `\`, "/")
+	base := path.Base(name)
+	switch {
+	case entry.FileInfo().IsDir(), strings.HasSuffix(name, "/"):
+		return true
+	case strings.HasPrefix(name, "__MACOSX/"), strings.HasPrefix(base, "._"):
+		return true
+	case base == ".DS_Store", strings.EqualFold(base, "Thumbs.db"):
+		return true
+	}
+	return false
+}
+
+// WriteZip writes a ZIP archive with the original of every image of the
+// gallery to w. The archive is streamed image by image, so it never has to
+// fit in memory or on disk. Images are stored without compression, they
+// are already compressed and wouldn't get any smaller.
+// Images keep the name they were uploaded with, numbered when several
+// share one.
+func (service *GalleryService) WriteZip(w io.Writer, galleryID int) error {
+	images, err := service.Images(galleryID)
+	if err != nil {
+		return fmt.Errorf("write zip: %w", err)
+	}
+
+	zw := zip.NewWriter(w)
+	used := make(map[string]bool)
+	for _, image := range images {
+		name := zipEntryName(image.OriginalFilename, used)
+		err = service.writeZipEntry(zw, image, name)
+		if err != nil {
+			return fmt.Errorf("write zip: %w", err)
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("write zip: %w", err)
+	}
+	return nil
+}
+
+func (service *GalleryService) writeZipEntry(zw *zip.Writer, image Image,
+	name string) error {
+	file, err := service.OpenImage(image, "")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entry, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: image.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, file)
+	return err
+}
+
+// zipEntryName returns filename, or "name (2).jpg" and so on if it was
+// already used. Names are compared case insensitively since not every
+// file system tells them apart.
+func zipEntryName(filename string, used map[string]bool) string {
+	name := filename
+	ext := path.Ext(filename)
+	for i := 2; used[strings.ToLower(name)]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(filename, ext), i, ext)
+	}
+	used[strings.ToLower(name)] = true
+	return name
+}
@@ -0,0 +1,230 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type zipEntry struct {
+	name     string
+	contents []byte
+}
+
+// buildZip returns a deflated ZIP archive holding entries.
+func buildZip(t *testing.T, entries ...zipEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write(entry.contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// The tests only use files that are rejected before CreateImage, which
+// needs a database.
+func TestCreateImagesFromZip(t *testing.T) {
+	tests := map[string]struct {
+		entries []zipEntry
+		// want is the Filename and FileError Issue of every result.
+		want [][2]string
+	}{
+		"directory traversal": {
+			[]zipEntry{
+				{"../../etc/passwd", nil},
+				{"/etc/shadow.txt", nil},
+				{`..\..\windows\win.ini`, nil},
+			},
+			[][2]string{
+				{"passwd", "invalid extension: "},
+				{"shadow.txt", "invalid extension: .txt"},
+				{"win.ini", "invalid extension: .ini"},
+			},
+		},
+		"skipped entries": {
+			[]zipEntry{
+				{"photos/", nil},
+				{"photos/notes.txt", nil},
+				{"__MACOSX/photos/._a.jpg", nil},
+				{"photos/.DS_Store", nil},
+			},
+			[][2]string{
+				{"notes.txt", "invalid extension: .txt"},
+			},
+		},
+		"entry too large": {
+			[]zipEntry{
+				{"big.jpg", make([]byte, MaxZipEntrySize+1)},
+			},
+			[][2]string{
+				{"big.jpg", fmt.Sprintf("the file is larger than %d MB",
+					MaxZipEntrySize>>20)},
+			},
+		},
+	}
+	service := &GalleryService{}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			data := buildZip(t, tc.entries...)
+			results, err := service.CreateImagesFromZip(1,
+				bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatalf("CreateImagesFromZip() err = %v", err)
+			}
+			if len(results) != len(tc.want) {
+				t.Fatalf("CreateImagesFromZip() returned %d results, want %d",
+					len(results), len(tc.want))
+			}
+			for i, result := range results {
+				var fileErr FileError
+				if !errors.As(result.Err, &fileErr) {
+					t.Errorf("%v: err = %v, want a FileError", result.Filename,
+						result.Err)
+					continue
+				}
+				got := [2]string{result.Filename, fileErr.Issue}
+				if got != tc.want[i] {
+					t.Errorf("result %d = %q, want %q", i, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCreateImagesFromZipDamaged(t *testing.T) {
+	// Stored entries keep their contents as is, so they are easy to
+	// corrupt.
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "a.jpg", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("original contents"))
+	zw.Close()
+	data := bytes.Replace(buf.Bytes(), []byte("original"), []byte("tampered"), 1)
+
+	results, err := (&GalleryService{}).CreateImagesFromZip(1,
+		bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("CreateImagesFromZip() err = %v", err)
+	}
+	var fileErr FileError
+	if len(results) != 1 || !errors.As(results[0].Err, &fileErr) ||
+		fileErr.Issue != "the file is damaged" {
+		t.Errorf("CreateImagesFromZip() = %+v, want a damaged file", results)
+	}
+}
+
+func TestCreateImagesFromZipInvalid(t *testing.T) {
+	tooMany := make([]zipEntry, MaxZipEntries+1)
+	for i := range tooMany {
+		tooMany[i] = zipEntry{name: fmt.Sprintf("%d.txt", i)}
+	}
+	// Skipped entries don't count towards the limit.
+	justEnough := make([]zipEntry, MaxZipEntries, MaxZipEntries+2)
+	for i := range justEnough {
+		justEnough[i] = zipEntry{name: fmt.Sprintf("%d.txt", i)}
+	}
+	justEnough = append(justEnough, zipEntry{name: "dir/"},
+		zipEntry{name: "__MACOSX/._0.txt"})
+
+	tests := map[string]struct {
+		data []byte
+		want error
+	}{
+		"not a zip":         {[]byte("this is not a zip archive"), ErrInvalidZip},
+		"empty":             {nil, ErrInvalidZip},
+		"too many entries":  {buildZip(t, tooMany...), ErrInvalidZip},
+		"just enough files": {buildZip(t, justEnough...), nil},
+	}
+	service := &GalleryService{}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := service.CreateImagesFromZip(1, bytes.NewReader(tc.data),
+				int64(len(tc.data)))
+			if !errors.Is(err, tc.want) {
+				t.Errorf("CreateImagesFromZip() err = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestSkipZipEntry(t *testing.T) {
+	tests := map[string]bool{
+		"photo.jpg":                 false,
+		"photos/2023/photo.jpg":     false,
+		`photos\photo.jpg`:          false,
+		"photos/":                   true,
+		`photos\`:                   true,
+		"__MACOSX/photo.jpg":        true,
+		"photos/._photo.jpg":        true,
+		".DS_Store":                 true,
+		"photos/thumbs.db":          true,
+		"photos/Thumbs.db.jpg":      false,
+		"photos/__MACOSX/photo.jpg": false,
+	}
+	for name, want := range tests {
+		t.Run(name, func(t *testing.T) {
+			entry := &zip.File{FileHeader: zip.FileHeader{Name: name}}
+			if got := skipZipEntry(entry); got != want {
+				t.Errorf("skipZipEntry(%q) = %v, want %v", name, got, want)
+			}
+		})
+	}
+}
+
+func TestZipEntryName(t *testing.T) {
+	tests := map[string]struct {
+		filenames []string
+		want      []string
+	}{
+		"unique": {
+			[]string{"a.jpg", "b.jpg"},
+			[]string{"a.jpg", "b.jpg"},
+		},
+		"duplicates": {
+			[]string{"a.jpg", "a.jpg", "a.jpg"},
+			[]string{"a.jpg", "a (2).jpg", "a (3).jpg"},
+		},
+		"different case": {
+			[]string{"a.jpg", "A.JPG"},
+			[]string{"a.jpg", "A (2).JPG"},
+		},
+		"numbered name already taken": {
+			[]string{"a (2).jpg", "a.jpg", "a.jpg"},
+			[]string{"a (2).jpg", "a.jpg", "a (3).jpg"},
+		},
+		"no extension": {
+			[]string{"photo", "photo"},
+			[]string{"photo", "photo (2)"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			used := make(map[string]bool)
+			var got []string
+			for _, filename := range tc.filenames {
+				got = append(got, zipEntryName(filename, used))
+			}
+			if strings.Join(got, "|") != strings.Join(tc.want, "|") {
+				t.Errorf("zipEntryName() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps failure counters in memory. It is the Store used by a
+// Limiter when none is set. The zero value is ready to use.
+type MemoryStore struct {
+	mu        sync.Mutex
+	failures  map[string]*failures
+	lastPrune time.Time
+	// now returns the current time, defaults to time.Now. Tests replace it
+	// so they don't have to wait for windows to pass.
+	now func() time.Time
+}
+
+type failures struct {
+	count int
+	start time.Time
+}
+
+func (s *MemoryStore) Add(key string, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures == nil {
+		s.failures = make(map[string]*failures)
+	}
+
+	now := s.clock()
+	f, ok := s.failures[key]
+	if !ok || now.Sub(f.start) > window {
+		// Use the chance to forget about keys that haven't failed in a
+		// while so the map doesn't grow forever.
+		s.prune(now, window)
+		f = &failures{start: now}
+		s.failures[key] = f
+	}
+	f.count++
+	return f.count, nil
+}
+
+func (s *MemoryStore) Count(key string, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.failures[key]
+	if !ok || s.clock().Sub(f.start) > window {
+		return 0, nil
+	}
+	return f.count, nil
+}
+
+func (s *MemoryStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.failures, key)
+	return nil
+}
+
+func (s *MemoryStore) prune(now time.Time, window time.Duration) {
+	if now.Sub(s.lastPrune) < window {
+		return
+	}
+	s.lastPrune = now
+
+	for key, f := range s.failures {
+		if now.Sub(f.start) > window {
+			delete(s.failures, key)
+		}
+	}
+}
+
+func (s *MemoryStore) clock() time.Time {
+	if s.now == nil {
+		return time.Now()
+	}
+	return s.now()
+}
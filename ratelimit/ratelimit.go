@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Store keeps the failure counters of a Limiter. The MemoryStore is fine
+// for a single server, but when running several of them behind a load
+// balancer they need a shared Store (Redis, Postgres, ...) so that an
+// attacker can't simply spread their attempts over the servers.
+type Store interface {
+	// Add records a failure for key and returns how many failures
+	// happened for key within the current window, including this one.
+	Add(key string, window time.Duration) (int, error)
+	// Count returns how many failures happened for key within the current
+	// window.
+	Count(key string, window time.Duration) (int, error)
+	// Reset forgets all failures for key.
+	Reset(key string) error
+}
+
+// Limiter counts failed attempts (wrong passwords, bad tokens, ...) per key
+// and stops allowing new attempts once Max failures happened within Window.
+// The counter for a key starts over once its window has passed.
+//
+// The zero value is not usable, Max and Window need to be set.
+type Limiter struct {
+	Max    int
+	Window time.Duration
+	// BaseDelay, when set, slows down attempts after a failure: each
+	// failure doubles the delay, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Store keeps the counters. Defaults to an in-memory store.
+	Store Store
+
+	memory MemoryStore
+}
+
+// Allow reports whether another attempt is allowed for key.
+//
+// If the Store fails the attempt is allowed. Locking everyone out because
+// the store is down would be worse than a few extra attempts.
+func (l *Limiter) Allow(key string) bool {
+	return l.Failures(key) < l.Max
+}
+
+// Failures returns the number of failures for key in the current window.
+func (l *Limiter) Failures(key string) int {
+	n, err := l.store().Count(key, l.Window)
+	if err != nil {
+		fmt.Println(fmt.Errorf("rate limit: %w", err))
+		return 0
+	}
+	return n
+}
+
+// Delay returns how long to wait before processing the next attempt for
+// key.
+func (l *Limiter) Delay(key string) time.Duration {
+	if l.BaseDelay <= 0 {
+		return 0
+	}
+	n := l.Failures(key)
+	if n == 0 {
+		return 0
+	}
+
+	delay := l.BaseDelay
+	for i := 1; i < n; i++ {
+		delay *= 2
+		if l.MaxDelay > 0 && delay >= l.MaxDelay {
+			return l.MaxDelay
+		}
+	}
+	return delay
+}
+
+// Fail records a failed attempt for key.
+func (l *Limiter) Fail(key string) {
+	_, err := l.store().Add(key, l.Window)
+	if err != nil {
+		fmt.Println(fmt.Errorf("rate limit: %w", err))
+	}
+}
+
+// Reset forgets all failures for key, for example after a successful
+// attempt.
+func (l *Limiter) Reset(key string) {
+	err := l.store().Reset(key)
+	if err != nil {
+		fmt.Println(fmt.Errorf("rate limit: %w", err))
+	}
+}
+
+func (l *Limiter) store() Store {
+	if l.Store == nil {
+		return &l.memory
+	}
+	return l.Store
+}
@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// testClock is a clock for the MemoryStore that only moves when told to.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func newTestLimiter(limit int, window time.Duration) (*Limiter, *testClock) {
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	l := &Limiter{
+		Max:    limit,
+		Window: window,
+	}
+	l.memory.now = clock.Now
+	return l, clock
+}
+
+func TestLimiterRefill(t *testing.T) {
+	type step struct {
+		// after is how long after the start the step happens.
+		after time.Duration
+		// fail records a failure, otherwise the counter is checked.
+		fail         bool
+		wantFailures int
+		wantAllow    bool
+	}
+	fail := func(after time.Duration) step { return step{after: after, fail: true} }
+	check := func(after time.Duration, failures int, allow bool) step {
+		return step{after: after, wantFailures: failures, wantAllow: allow}
+	}
+
+	tests := map[string][]step{
+		"under max": {
+			fail(0), fail(time.Second),
+			check(2*time.Second, 2, true),
+		},
+		"at max": {
+			fail(0), fail(time.Second), fail(2 * time.Second),
+			check(3*time.Second, 3, false),
+		},
+		"refilled after the window": {
+			fail(0), fail(time.Second), fail(2 * time.Second),
+			check(time.Minute, 3, false),
+			check(time.Minute+time.Second, 0, true),
+		},
+		"window starts at the first failure": {
+			fail(0), fail(59 * time.Second), fail(59 * time.Second),
+			check(59*time.Second, 3, false),
+			check(61*time.Second, 0, true),
+		},
+		"new window after the old one passed": {
+			fail(0), fail(time.Second), fail(2 * time.Second),
+			fail(61 * time.Second),
+			check(62*time.Second, 1, true),
+			check(121*time.Second, 1, true),
+			check(122*time.Second, 0, true),
+		},
+	}
+	for name, steps := range tests {
+		t.Run(name, func(t *testing.T) {
+			l, clock := newTestLimiter(3, time.Minute)
+			start := clock.now
+			for i, s := range steps {
+				clock.now = start.Add(s.after)
+				if s.fail {
+					l.Fail("key")
+					continue
+				}
+				if got := l.Failures("key"); got != s.wantFailures {
+					t.Errorf("step %d: Failures() = %d, want %d", i, got,
+						s.wantFailures)
+				}
+				if got := l.Allow("key"); got != s.wantAllow {
+					t.Errorf("step %d: Allow() = %v, want %v", i, got, s.wantAllow)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterKeys(t *testing.T) {
+	l, _ := newTestLimiter(1, time.Minute)
+	l.Fail("a")
+	if l.Allow("a") {
+		t.Errorf("Allow(a) = true after Max failures, want false")
+	}
+	if !l.Allow("b") {
+		t.Errorf("Allow(b) = false, want true, failures of a don't count")
+	}
+	l.Reset("a")
+	if !l.Allow("a") {
+		t.Errorf("Allow(a) = false after Reset, want true")
+	}
+}
+
+func TestLimiterDelay(t *testing.T) {
+	tests := map[int]time.Duration{
+		0: 0,
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 8 * time.Second,
+		5: 10 * time.Second,
+		9: 10 * time.Second,
+	}
+	for failures, want := range tests {
+		l, _ := newTestLimiter(10, time.Minute)
+		l.BaseDelay = time.Second
+		l.MaxDelay = 10 * time.Second
+		for i := 0; i < failures; i++ {
+			l.Fail("key")
+		}
+		if got := l.Delay("key"); got != want {
+			t.Errorf("Delay() after %d failures = %v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestMemoryStorePrune(t *testing.T) {
+	l, clock := newTestLimiter(3, time.Minute)
+	l.Fail("old")
+	clock.now = clock.now.Add(2 * time.Minute)
+	l.Fail("new")
+
+	if _, ok := l.memory.failures["old"]; ok {
+		t.Errorf("failures of old are still kept after their window passed")
+	}
+	if _, ok := l.memory.failures["new"]; !ok {
+		t.Errorf("failures of new were pruned")
+	}
+}
@@ -0,0 +1,140 @@
+package views
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+// markdown renders the small part of Markdown that gallery descriptions
+// need: paragraphs, headings, lists, bold, italics, inline code and links.
+// Everything the user typed is escaped before any tag is added, so the
+// only HTML in the result is the handful of tags produced here. Links are
+// limited to http, https and mailto so they can't run scripts.
+func markdown(src string) template.HTML {
+	var b strings.Builder
+	// list is the tag of the list being rendered, if any, and para holds
+	// the lines of the paragraph being rendered.
+	var list string
+	var para []string
+
+	flushPara := func() {
+		if len(para) > 0 {
+			b.WriteString(`<p class="pb-2">`)
+			b.WriteString(strings.Join(para, "<br>"))
+			b.WriteString("</p>")
+			para = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			b.WriteString("</" + list + ">")
+			list = ""
+		}
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		line = strings.TrimRight(line, " \t")
+		trimmed := strings.TrimLeft(line, " \t")
+
+		if trimmed == "" {
+			flushPara()
+			closeList()
+			continue
+		}
+
+		if level, text, ok := markdownHeading(trimmed); ok {
+			flushPara()
+			closeList()
+			// The page title is the only h1 and h2, so headings start at h3.
+			tag := []string{"h3", "h4", "h5"}[min(level, 3)-1]
+			b.WriteString(`<` + tag + ` class="pt-2 pb-1 font-semibold">`)
+			b.WriteString(markdownInline(text))
+			b.WriteString("</" + tag + ">")
+			continue
+		}
+
+		if tag, text, ok := markdownListItem(trimmed); ok {
+			flushPara()
+			if list != tag {
+				closeList()
+				list = tag
+				class := "list-disc"
+				if tag == "ol" {
+					class = "list-decimal"
+				}
+				b.WriteString(`<` + tag + ` class="pb-2 pl-6 ` + class + `">`)
+			}
+			b.WriteString("<li>" + markdownInline(text) + "</li>")
+			continue
+		}
+
+		closeList()
+		para = append(para, markdownInline(trimmed))
+	}
+	flushPara()
+	closeList()
+
+	return template.HTML(b.String())
+}
+
+// markdownHeading parses "# Heading" lines.
+func markdownHeading(line string) (int, string, bool) {
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || level == len(line) || line[level] != ' ' {
+		return 0, "", false
+	}
+	return level, strings.TrimSpace(line[level:]), true
+}
+
+var orderedItem = regexp.MustCompile(`^[0-9]+[.)] `)
+
+// markdownListItem parses "- item", "* item" and "1. item" lines and
+// returns the tag of the list they belong to.
+func markdownListItem(line string) (string, string, bool) {
+	if strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ") {
+		return "ul", strings.TrimSpace(line[2:]), true
+	}
+	if loc := orderedItem.FindStringIndex(line); loc != nil {
+		return "ol", strings.TrimSpace(line[loc[1]:]), true
+	}
+	return "", "", false
+}
+
+var (
+	strongText = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	emText     = regexp.MustCompile(`\*([^*\s][^*]*)\*`)
+	// Links are matched after escaping, so URLs can't hold quotes or
+	// angle brackets anymore.
+	linkText = regexp.MustCompile(`\[([^\]]+)\]\(((?:https?://|mailto:)[^)\s]+)\)`)
+)
+
+// markdownInline escapes text and renders the inline formatting in it.
+// Nothing is formatted inside `code`.
+func markdownInline(text string) string {
+	parts := strings.Split(text, "`")
+	// An unmatched backtick is just a backtick.
+	if len(parts)%2 == 0 {
+		parts[len(parts)-2] += "`" + parts[len(parts)-1]
+		parts = parts[:len(parts)-1]
+	}
+
+	var b strings.Builder
+	for i, part := range parts {
+		part = html.EscapeString(part)
+		if i%2 == 1 {
+			b.WriteString(`<code class="px-1 bg-gray-100 rounded">` + part + "</code>")
+			continue
+		}
+		part = strongText.ReplaceAllString(part, "<strong>$1</strong>")
+		part = emText.ReplaceAllString(part, "<em>$1</em>")
+		part = linkText.ReplaceAllString(part,
+			`<a class="underline" href="$2" rel="nofollow noopener">$1</a>`)
+		b.WriteString(part)
+	}
+	return b.String()
+}
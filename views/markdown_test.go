@@ -0,0 +1,111 @@
+package views
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestMarkdown(t *testing.T) {
+	const p = `<p class="pb-2">`
+	tests := map[string]struct {
+		src  string
+		want string
+	}{
+		"paragraphs": {
+			"line 1\nline 2\r\n\npara 2",
+			p + "line 1<br>line 2</p>" + p + "para 2</p>",
+		},
+		"headings": {
+			"# Title\n## Sub\n#### Deep\n#no space",
+			`<h3 class="pt-2 pb-1 font-semibold">Title</h3>` +
+				`<h4 class="pt-2 pb-1 font-semibold">Sub</h4>` +
+				`<h5 class="pt-2 pb-1 font-semibold">Deep</h5>` +
+				p + "#no space</p>",
+		},
+		"lists": {
+			"- a\n* b\n1. c\n2) d",
+			`<ul class="pb-2 pl-6 list-disc"><li>a</li><li>b</li></ul>` +
+				`<ol class="pb-2 pl-6 list-decimal"><li>c</li><li>d</li></ol>`,
+		},
+		"bold and italics": {
+			"**bold** and *em*",
+			p + "<strong>bold</strong> and <em>em</em></p>",
+		},
+		"code": {
+			"`**not bold** <i>` and a ` backtick",
+			p + `<code class="px-1 bg-gray-100 rounded">**not bold** &lt;i&gt;</code>` +
+				" and a ` backtick</p>",
+		},
+		"links": {
+			"[site](https://example.com/a?b=1&c=2) [mail](mailto:jon@example.com)",
+			p + `<a class="underline" href="https://example.com/a?b=1&amp;c=2" ` +
+				`rel="nofollow noopener">site</a> ` +
+				`<a class="underline" href="mailto:jon@example.com" ` +
+				`rel="nofollow noopener">mail</a></p>`,
+		},
+		"html is escaped": {
+			`<script>alert(1)</script> Tom & "Jerry" 'x'`,
+			p + "&lt;script&gt;alert(1)&lt;/script&gt; Tom &amp; &#34;Jerry&#34; " +
+				"&#39;x&#39;</p>",
+		},
+		"html in link text": {
+			"[<b>x</b>](https://example.com)",
+			p + `<a class="underline" href="https://example.com" ` +
+				`rel="nofollow noopener">&lt;b&gt;x&lt;/b&gt;</a></p>`,
+		},
+		"javascript link": {
+			"[click](javascript:alert(1))",
+			p + "[click](javascript:alert(1))</p>",
+		},
+		"data link": {
+			"[click](data:text/html,<script>)",
+			p + "[click](data:text/html,&lt;script&gt;)</p>",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := string(markdown(tc.src))
+			if got != tc.want {
+				t.Errorf("markdown(%q) =\n%s\nwant\n%s", tc.src, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestMarkdownUnsafe only checks that no tags, attributes or links other
+// than the safe ones get through, for input where the exact output doesn't
+// matter.
+func TestMarkdownUnsafe(t *testing.T) {
+	tests := []string{
+		"[click](javascript:alert(1))",
+		"[click](JavaScript:alert(1))",
+		"[click]( javascript:alert(1))",
+		"[click](java\tscript:alert(1))",
+		"[click](vbscript:msgbox(1))",
+		"[click](https://example.com\"onmouseover=\"alert(1))",
+		"[click](https://example.com'onmouseover='alert(1))",
+		"[click](https://example.com><script>alert(1)</script>)",
+		"[[click](https://example.com)](javascript:alert(1))",
+		"**<img src=x onerror=alert(1)>**",
+		"`</code><script>alert(1)</script>`",
+		"# <svg onload=alert(1)>",
+		"- <iframe src=javascript:alert(1)>",
+	}
+	// User input is escaped, so every tag in the output is one markdown
+	// produced. Those are checked against what it is allowed to produce.
+	tags := regexp.MustCompile(`<[^>]*>`)
+	allowed := regexp.MustCompile(`^</?(p|h3|h4|h5|ul|ol|li|strong|em|code|br)` +
+		`( class="[a-z0-9 -]+")?>$|` +
+		`^<a class="underline" href="(https?://|mailto:)[^"<>\s]+" ` +
+		`rel="nofollow noopener">$|^</a>$`)
+	for _, src := range tests {
+		t.Run(src, func(t *testing.T) {
+			got := string(markdown(src))
+			for _, tag := range tags.FindAllString(got, -1) {
+				if !allowed.MatchString(tag) {
+					t.Errorf("markdown(%q) = %s, unexpected tag %s", src, got, tag)
+				}
+			}
+		})
+	}
+}
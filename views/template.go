@@ -51,6 +51,9 @@ func ParseFS(fs fs.FS, patterns ...string) (Template, error) {
 			"errors": func() []string {
 				return nil
 			},
+			// markdown doesn't depend on the request, so unlike the functions
+			// above it is the real thing right away.
+			"markdown": markdown,
 		},
 	)
 